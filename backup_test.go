@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/raestrada/sappers/consensus/service"
+	"github.com/raestrada/sappers/consensus/store"
+	"github.com/raestrada/sappers/consensus/store/storetest"
+)
+
+func TestCommandArgs(t *testing.T) {
+	snap := filepath.Join(t.TempDir(), "backup.snap")
+	if err := os.WriteFile(snap, []byte("not a snapshot"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		run  func([]string) error
+		args []string
+	}{
+		{"backup with an argument", runBackup, []string{"extra"}},
+		{"backup with an unknown flag", runBackup, []string{"--raft-dir", "raft"}},
+		{"restore without a snapshot", runRestore, nil},
+		{"restore with two snapshots", runRestore, []string{snap, snap}},
+		{"restore with an unknown flag", runRestore, []string{"--http-addr", ":11000", snap}},
+		{"restore of a missing file", runRestore, []string{"--raft-dir", t.TempDir(), filepath.Join(t.TempDir(), "missing.snap")}},
+		{"restore of a corrupted file", runRestore, []string{"--raft-dir", t.TempDir(), "--raft-addr", "127.0.0.1:0", snap}},
+	} {
+		if err := tc.run(tc.args); err == nil {
+			t.Errorf("%s: got no error", tc.name)
+		}
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	s := storetest.New(t, 1).Leader().Store
+	if err := s.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(service.New("", s))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	snap := filepath.Join(dir, "backup.snap")
+	if err := runBackup([]string{"--http-addr", srv.URL, "-o", snap}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(snap + ".meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta store.SnapshotMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.ID == "" || meta.Index == 0 || meta.Size != info.Size() {
+		t.Fatalf("meta %+v does not describe the %d byte snapshot", meta, info.Size())
+	}
+
+	raftDir := filepath.Join(dir, "raft")
+	args := []string{"--raft-dir", raftDir, "--node-id", "node0", "--raft-addr", "127.0.0.1:0", snap}
+	if err := runRestore(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := runRestore(args); err == nil {
+		t.Fatal("restored into a directory that already holds a snapshot")
+	}
+}
@@ -2,6 +2,8 @@ package config
 
 import (
     "sync"
+    "time"
+    "github.com/raestrada/sappers/consensus/store"
     "github.com/spf13/viper"
 )
 
@@ -13,6 +15,31 @@ type Config struct {
     Peers      []string
     LogLevel   string
 	RaftDir    string
+	ForwardWrites bool
+	SnapshotCompression bool
+	FSMBackend string
+	BatchMaxSize int
+	BatchDelay time.Duration
+	RaftHeartbeatTimeout time.Duration
+	RaftElectionTimeout time.Duration
+	RaftLeaderLeaseTimeout time.Duration
+	RaftCommitTimeout time.Duration
+	RaftSnapshotInterval time.Duration
+	RaftSnapshotThreshold uint64
+	RaftTrailingLogs uint64
+	RaftRetainSnapshots int
+	RaftApplyTimeout time.Duration
+	VoterTarget int
+	ServerStabilization time.Duration
+	PromotionMaxLag uint64
+	LeaveOnTerminate bool
+	DeadServerGrace time.Duration
+	MinQuorum int
+	RecoverPeers []string
+	RaftTLSCert string
+	RaftTLSKey string
+	RaftTLSCA string
+	RaftTLSVerifyID bool
 }
 
 var (
@@ -31,6 +58,33 @@ func GetConfig() *Config {
         viper.SetDefault("log-level", "ERROR")  
         viper.SetDefault("peers", []string{"127.0.0.1"})
 		viper.SetDefault("raft-dir", "raft/node")
+		viper.SetDefault("forward-writes", true)
+		viper.SetDefault("snapshot-compression", false)
+		viper.SetDefault("fsm-backend", "memory")
+		viper.SetDefault("batch-max-size", 128)
+		viper.SetDefault("batch-delay", "0s")
+		// Los parámetros de Raft toman por defecto los del almacén
+		tuning := store.DefaultRaftTuning()
+		viper.SetDefault("raft-heartbeat-timeout", tuning.HeartbeatTimeout)
+		viper.SetDefault("raft-election-timeout", tuning.ElectionTimeout)
+		viper.SetDefault("raft-leader-lease-timeout", tuning.LeaderLeaseTimeout)
+		viper.SetDefault("raft-commit-timeout", tuning.CommitTimeout)
+		viper.SetDefault("raft-snapshot-interval", tuning.SnapshotInterval)
+		viper.SetDefault("raft-snapshot-threshold", tuning.SnapshotThreshold)
+		viper.SetDefault("raft-trailing-logs", tuning.TrailingLogs)
+		viper.SetDefault("raft-retain-snapshots", tuning.RetainSnapshots)
+		viper.SetDefault("raft-apply-timeout", tuning.ApplyTimeout)
+		viper.SetDefault("voter-target", 0)
+		viper.SetDefault("server-stabilization", "10s")
+		viper.SetDefault("promotion-max-lag", 1024)
+		viper.SetDefault("leave-on-terminate", false)
+		viper.SetDefault("dead-server-grace", "5m")
+		viper.SetDefault("min-quorum", 0)
+		viper.SetDefault("recover-peers", []string{})
+		viper.SetDefault("raft-tls-cert", "")
+		viper.SetDefault("raft-tls-key", "")
+		viper.SetDefault("raft-tls-ca", "")
+		viper.SetDefault("raft-tls-verify-id", true)
 
         viper.BindEnv("gossip-port")
         viper.BindEnv("raft-addr")
@@ -39,6 +93,31 @@ func GetConfig() *Config {
         viper.BindEnv("log-level")
         viper.BindEnv("peers")
 		viper.BindEnv("raft-dir")
+		viper.BindEnv("forward-writes")
+		viper.BindEnv("snapshot-compression")
+		viper.BindEnv("fsm-backend")
+		viper.BindEnv("batch-max-size")
+		viper.BindEnv("batch-delay")
+		viper.BindEnv("raft-heartbeat-timeout")
+		viper.BindEnv("raft-election-timeout")
+		viper.BindEnv("raft-leader-lease-timeout")
+		viper.BindEnv("raft-commit-timeout")
+		viper.BindEnv("raft-snapshot-interval")
+		viper.BindEnv("raft-snapshot-threshold")
+		viper.BindEnv("raft-trailing-logs")
+		viper.BindEnv("raft-retain-snapshots")
+		viper.BindEnv("raft-apply-timeout")
+		viper.BindEnv("voter-target")
+		viper.BindEnv("server-stabilization")
+		viper.BindEnv("promotion-max-lag")
+		viper.BindEnv("leave-on-terminate")
+		viper.BindEnv("dead-server-grace")
+		viper.BindEnv("min-quorum")
+		viper.BindEnv("recover-peers")
+		viper.BindEnv("raft-tls-cert")
+		viper.BindEnv("raft-tls-key")
+		viper.BindEnv("raft-tls-ca")
+		viper.BindEnv("raft-tls-verify-id")
 
         // Parsear peers como una lista
         peers := viper.GetStringSlice("peers")
@@ -51,6 +130,31 @@ func GetConfig() *Config {
             LogLevel:   viper.GetString("log-level"), 
             Peers:      peers,
 			RaftDir:    viper.GetString("raft-dir"), 
+			ForwardWrites: viper.GetBool("forward-writes"),
+			SnapshotCompression: viper.GetBool("snapshot-compression"),
+			FSMBackend: viper.GetString("fsm-backend"),
+			BatchMaxSize: viper.GetInt("batch-max-size"),
+			BatchDelay: viper.GetDuration("batch-delay"),
+			RaftHeartbeatTimeout: viper.GetDuration("raft-heartbeat-timeout"),
+			RaftElectionTimeout: viper.GetDuration("raft-election-timeout"),
+			RaftLeaderLeaseTimeout: viper.GetDuration("raft-leader-lease-timeout"),
+			RaftCommitTimeout: viper.GetDuration("raft-commit-timeout"),
+			RaftSnapshotInterval: viper.GetDuration("raft-snapshot-interval"),
+			RaftSnapshotThreshold: viper.GetUint64("raft-snapshot-threshold"),
+			RaftTrailingLogs: viper.GetUint64("raft-trailing-logs"),
+			RaftRetainSnapshots: viper.GetInt("raft-retain-snapshots"),
+			RaftApplyTimeout: viper.GetDuration("raft-apply-timeout"),
+			VoterTarget: viper.GetInt("voter-target"),
+			ServerStabilization: viper.GetDuration("server-stabilization"),
+			PromotionMaxLag: viper.GetUint64("promotion-max-lag"),
+			LeaveOnTerminate: viper.GetBool("leave-on-terminate"),
+			DeadServerGrace: viper.GetDuration("dead-server-grace"),
+			MinQuorum: viper.GetInt("min-quorum"),
+			RecoverPeers: viper.GetStringSlice("recover-peers"),
+			RaftTLSCert: viper.GetString("raft-tls-cert"),
+			RaftTLSKey: viper.GetString("raft-tls-key"),
+			RaftTLSCA: viper.GetString("raft-tls-ca"),
+			RaftTLSVerifyID: viper.GetBool("raft-tls-verify-id"),
         }
     })
     return config
@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"time"
 
+	"github.com/raestrada/sappers/config"
 	"github.com/raestrada/sappers/consensus/service"
 	"github.com/raestrada/sappers/consensus/store"
 	"github.com/raestrada/sappers/members"
@@ -23,6 +25,21 @@ type Consensus struct {
 	raftAddr     string
 	joinAddr     string
 	nodeID       string
+	forward      bool
+	compress     bool
+	fsmBackend   string
+	batchMaxSize int
+	batchDelay   time.Duration
+	tuning       store.RaftTuning
+	voterTarget  int
+	stabilize    time.Duration
+	maxLag       uint64
+	leave        bool
+	deadGrace    time.Duration
+	minQuorum    int
+	recoverPeers []store.Server
+	raftTLS      *store.TLSConfig
+	store        *store.Store
 	memberList   members.MemberList
 	knownMembers map[string]struct{} // Rastrea los miembros conocidos para evitar uniones duplicadas
 }
@@ -32,7 +49,8 @@ type ConsensusFactory struct{}
 
 // Create crea una nueva instancia de Consensus usando la configuración global.
 func (f ConsensusFactory) Create(memberList members.MemberList) *Consensus {
-	cfg := config.GetConfig() // Obtener la configuración desde el singleton
+	cfg := config.GetConfig()              // Obtener la configuración desde el singleton
+	recoverPeers, _ := recoverServers(cfg) // Ya validados al arrancar
 
 	return &Consensus{
 		raftDir:      cfg.RaftDir,
@@ -40,11 +58,75 @@ func (f ConsensusFactory) Create(memberList members.MemberList) *Consensus {
 		httpAddr:     cfg.HTTPAddr,
 		raftAddr:     cfg.RaftAddr,
 		nodeID:       cfg.NodeID,
+		forward:      cfg.ForwardWrites,
+		compress:     cfg.SnapshotCompression,
+		fsmBackend:   cfg.FSMBackend,
+		batchMaxSize: cfg.BatchMaxSize,
+		batchDelay:   cfg.BatchDelay,
+		tuning:       raftTuning(cfg),
+		voterTarget:  cfg.VoterTarget,
+		stabilize:    cfg.ServerStabilization,
+		maxLag:       cfg.PromotionMaxLag,
+		leave:        cfg.LeaveOnTerminate,
+		deadGrace:    cfg.DeadServerGrace,
+		minQuorum:    cfg.MinQuorum,
+		recoverPeers: recoverPeers,
+		raftTLS:      raftTLS(cfg),
 		memberList:   memberList,
 		knownMembers: make(map[string]struct{}), // Inicializar el mapa de miembros conocidos
 	}
 }
 
+// ValidateConfig comprueba los parámetros de Raft, los servidores de
+// recuperación y el TLS de Raft de la configuración antes de arrancar nada.
+func ValidateConfig(cfg *config.Config) error {
+	if err := raftTuning(cfg).Validate(); err != nil {
+		return err
+	}
+	if _, err := recoverServers(cfg); err != nil {
+		return err
+	}
+	if tlsConfig := raftTLS(cfg); tlsConfig != nil {
+		return tlsConfig.Validate()
+	}
+	return nil
+}
+
+// raftTuning devuelve los parámetros de Raft de la configuración.
+func raftTuning(cfg *config.Config) store.RaftTuning {
+	return store.RaftTuning{
+		HeartbeatTimeout:   cfg.RaftHeartbeatTimeout,
+		ElectionTimeout:    cfg.RaftElectionTimeout,
+		LeaderLeaseTimeout: cfg.RaftLeaderLeaseTimeout,
+		CommitTimeout:      cfg.RaftCommitTimeout,
+		SnapshotInterval:   cfg.RaftSnapshotInterval,
+		SnapshotThreshold:  cfg.RaftSnapshotThreshold,
+		TrailingLogs:       cfg.RaftTrailingLogs,
+		RetainSnapshots:    cfg.RaftRetainSnapshots,
+		ApplyTimeout:       cfg.RaftApplyTimeout,
+	}
+}
+
+// recoverServers devuelve los servidores con los que recuperar el clúster en
+// modo de recuperación, o ninguno si el nodo arranca normalmente.
+func recoverServers(cfg *config.Config) ([]store.Server, error) {
+	return store.ParsePeers(cfg.RecoverPeers)
+}
+
+// raftTLS devuelve la configuración TLS del transporte de Raft, o nil si Raft
+// no usa TLS. Basta con indicar alguno de los ficheros para activarlo.
+func raftTLS(cfg *config.Config) *store.TLSConfig {
+	if cfg.RaftTLSCert == "" && cfg.RaftTLSKey == "" && cfg.RaftTLSCA == "" {
+		return nil
+	}
+	return &store.TLSConfig{
+		CertFile:       cfg.RaftTLSCert,
+		KeyFile:        cfg.RaftTLSKey,
+		CAFile:         cfg.RaftTLSCA,
+		VerifyServerID: cfg.RaftTLSVerifyID,
+	}
+}
+
 // Init inicializa el nodo de Raft y empieza el servicio de consenso.
 func (c *Consensus) Init(ctx context.Context) {
 	funcDesc := "Consensus - Init"
@@ -59,6 +141,22 @@ func (c *Consensus) Init(ctx context.Context) {
 	s := store.New(c.inMem)
 	s.RaftDir = c.raftDir
 	s.RaftBind = c.raftAddr
+	s.HTTPAddr = c.httpAddr
+	c.store = s
+	s.CompressSnapshots = c.compress
+	s.Backend = c.fsmBackend
+	s.BatchMaxSize = c.batchMaxSize
+	s.BatchDelay = c.batchDelay
+	s.Tuning = c.tuning
+	s.VoterTarget = c.voterTarget
+	s.ServerStabilization = c.stabilize
+	s.MaxPromotionLag = c.maxLag
+	s.StatusOf = service.FetchStatus
+	s.LiveMembers = c.liveMembers
+	s.DeadServerGrace = c.deadGrace
+	s.MinQuorum = c.minQuorum
+	s.RecoverPeers = c.recoverPeers
+	s.TLS = c.raftTLS
 
 	// Abrir el almacén de Raft, ya sea como un nuevo clúster o uniéndose a uno existente
 	if err := s.Open(c.joinAddr == "", c.nodeID); err != nil {
@@ -67,6 +165,8 @@ func (c *Consensus) Init(ctx context.Context) {
 
 	// Iniciar el servicio HTTP para gestionar Raft
 	h := service.New(c.httpAddr, s)
+	h.Forward = c.forward
+	h.Members = c.gossipMembers
 	if err := h.Start(); err != nil {
 		zap.L().Fatal(funcDesc, zap.String("type", "failed to start HTTP service"), zap.Error(err))
 	}
@@ -80,10 +180,69 @@ func (c *Consensus) Init(ctx context.Context) {
 	select {
 	case <-ctx.Done():
 		zap.L().Info(funcDesc, zap.String("msg", "Shutting down Raft node"))
+		c.leaveCluster(h)
 		return
 	}
 }
 
+// leaveTimeout limita cuánto espera un nodo a que el líder lo quite de la
+// configuración de Raft al apagarse.
+const leaveTimeout = 10 * time.Second
+
+// leaveCluster apaga el nodo de forma ordenada: cede el liderazgo si lo tiene,
+// para que el clúster no espere a que expire el timeout de elección, pide al
+// líder que lo quite de la configuración de Raft si así se configuró, y cierra
+// el servicio HTTP y el almacén.
+func (c *Consensus) leaveCluster(h *service.Service) {
+	funcDesc := "Consensus - leaveCluster"
+
+	err := c.store.TransferLeadership("")
+	if err != nil && !errors.Is(err, store.ErrNotLeader) && err != store.ErrNoTransferTarget {
+		zap.L().Warn(funcDesc, zap.String("type", "failed to transfer leadership"), zap.Error(err))
+	}
+
+	if c.leave {
+		if err := c.removeSelf(); err != nil {
+			zap.L().Warn(funcDesc, zap.String("type", "failed to leave the Raft configuration"), zap.Error(err))
+		}
+	}
+
+	h.Close()
+	if err := c.store.Close(); err != nil {
+		zap.L().Error(funcDesc, zap.String("type", "failed to close store"), zap.Error(err))
+	}
+	zap.L().Info(funcDesc, zap.String("msg", "Raft node stopped"), zap.String("nodeID", c.nodeID))
+}
+
+// removeSelf pide al líder que quite este nodo de la configuración de Raft,
+// reintentando mientras se elige un líder tras la cesión del liderazgo.
+func (c *Consensus) removeSelf() error {
+	funcDesc := "Consensus - removeSelf"
+
+	deadline := time.Now().Add(leaveTimeout)
+	for {
+		err := c.store.RemoveServer(c.nodeID)
+		var nle *store.NotLeaderError
+		if errors.As(err, &nle) && nle.LeaderAPIAddr != "" {
+			err = service.RemoveServer(nle.LeaderAPIAddr, c.nodeID, leaveTimeout)
+		}
+
+		switch {
+		case err == nil:
+			zap.L().Info(funcDesc, zap.String("msg", "left the Raft configuration"), zap.String("nodeID", c.nodeID))
+			return nil
+		case err == store.ErrServerNotFound:
+			return nil
+		case err == store.ErrLastVoter:
+			// Un nodo solo no se quita a sí mismo: el clúster no podría volver a arrancar
+			return nil
+		case time.Now().After(deadline):
+			return err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
 // monitorGossipForNewMembers verifica continuamente nuevos miembros y trata de agregarlos al clúster de Raft.
 func (c *Consensus) monitorGossipForNewMembers(ctx context.Context) {
 	funcDesc := "Consensus - monitorGossipForNewMembers"
@@ -116,6 +275,25 @@ func (c *Consensus) monitorGossipForNewMembers(ctx context.Context) {
 	}
 }
 
+// gossipMembers devuelve la lista de miembros de gossip para el estado del nodo.
+func (c *Consensus) gossipMembers() []service.Member {
+	var list []service.Member
+	for _, m := range c.memberList.Get() {
+		list = append(list, service.Member{Name: m.Name, Addr: m.Addr})
+	}
+	return list
+}
+
+// liveMembers devuelve los IDs de los nodos vivos según gossip. Los nodos se
+// anuncian en gossip con su ID de nodo, el mismo que usan en Raft.
+func (c *Consensus) liveMembers() []string {
+	var ids []string
+	for _, m := range c.memberList.Get() {
+		ids = append(ids, m.Name)
+	}
+	return ids
+}
+
 // isKnownMember verifica si un miembro ya es conocido.
 func (c *Consensus) isKnownMember(addr string) bool {
 	_, exists := c.knownMembers[addr]
@@ -131,8 +309,17 @@ func (c *Consensus) markMemberAsKnown(addr string) {
 func (c *Consensus) joinCluster(joinAddr, raftAddr, nodeID string) error {
 	funcDesc := "Consensus - JoinCluster"
 
-	// Preparar el payload para la solicitud de unión
-	payload := map[string]string{"addr": raftAddr, "id": nodeID}
+	// Preparar el payload para la solicitud de unión, con la dirección HTTP
+	// para que el líder pueda recibir las escrituras reenviadas y los
+	// comandos que este nodo sabe aplicar
+	meta := c.store.LocalNodeMeta()
+	payload := map[string]interface{}{
+		"addr":            raftAddr,
+		"id":              nodeID,
+		"api_addr":        meta.APIAddr,
+		"command_version": meta.CommandVersion,
+		"ops":             meta.Ops,
+	}
 	b, err := json.Marshal(payload)
 	if err != nil {
 		zap.L().Error(funcDesc, zap.String("type", "failed to marshal JSON"), zap.Error(err))
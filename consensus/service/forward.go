@@ -0,0 +1,175 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/raestrada/sappers/consensus/store"
+	"go.uber.org/zap"
+)
+
+const (
+	// forwardedHeader marks a request forwarded by another node. It is never
+	// forwarded again, so a request cannot bounce between nodes.
+	forwardedHeader = "X-Sappers-Forwarded"
+
+	// leaderHeader carries the API address of the leader on a not-leader
+	// response.
+	leaderHeader = "X-Sappers-Leader"
+
+	// maxForwardAttempts bounds how many times a request is sent to a leader
+	// when leadership changes while it is being forwarded.
+	maxForwardAttempts = 3
+
+	// forwardRetryDelay is the base delay before retrying with a new leader.
+	forwardRetryDelay = 250 * time.Millisecond
+
+	// forwardTimeoutMargin is added to the Raft apply timeout to bound a
+	// forwarded request, so that the leader times out first.
+	forwardTimeoutMargin = 5 * time.Second
+
+	// maxBufferedBody bounds the body of a request buffered for forwarding.
+	maxBufferedBody = 16 << 20
+)
+
+// bufferBody reads the body of r so that it can be sent again when the
+// request is forwarded to the leader. A body larger than maxBufferedBody
+// fails with an *http.MaxBytesError.
+func bufferBody(w http.ResponseWriter, r *http.Request) error {
+	if r.Body == nil {
+		return nil
+	}
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBufferedBody))
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	return nil
+}
+
+// forward sends r to the leader named by nle and copies the response back to
+// w. If the leader cannot be reached, or answers that it no longer leads, the
+// leader is looked up again, at most maxForwardAttempts times.
+func (s *Service) forward(w http.ResponseWriter, r *http.Request, nle *store.NotLeaderError) {
+	funcDesc := "service - forward"
+
+	client := &http.Client{Timeout: s.store.ApplyTimeout() + forwardTimeoutMargin}
+	addr := nle.LeaderAPIAddr
+	for attempt := 0; attempt < maxForwardAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * forwardRetryDelay)
+			addr = s.store.LeaderAPIAddr()
+		}
+		if addr == "" {
+			continue
+		}
+
+		resp, err := forwardTo(client, addr, r)
+		if err != nil {
+			zap.L().Warn(
+				funcDesc,
+				zap.String("type", fmt.Sprintf("failed to forward request to leader at %s", addr)),
+				zap.String("msg", err.Error()),
+			)
+			// A request that never reached the leader can be sent again. Any
+			// other failure may come after the leader applied it, so the
+			// client decides whether to retry.
+			if isDialError(err) {
+				continue
+			}
+			if isTimeout(err) {
+				w.WriteHeader(http.StatusGatewayTimeout)
+			} else {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+			return
+		}
+		if resp.StatusCode == http.StatusServiceUnavailable && len(resp.Header.Values(leaderHeader)) > 0 {
+			// The node we reached is no longer the leader.
+			resp.Body.Close()
+			continue
+		}
+
+		defer resp.Body.Close()
+		for k, vs := range resp.Header {
+			for _, v := range vs {
+				w.Header().Add(k, v)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	writeNotLeader(w, &store.NotLeaderError{LeaderAPIAddr: s.store.LeaderAPIAddr()})
+}
+
+// forwardTo replays r against the HTTP API at addr.
+func forwardTo(client *http.Client, addr string, r *http.Request) (*http.Response, error) {
+	var body io.Reader
+	if r.GetBody != nil {
+		rc, err := r.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		body = rc
+	}
+
+	u := *r.URL
+	u.Scheme = "http"
+	u.Host = addr
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Set(forwardedHeader, "true")
+	return client.Do(req)
+}
+
+// isDialError reports whether err happened while connecting, before any of
+// the request was sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isTimeout reports whether err is a timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// notLeader returns the not-leader error carried by err, if any.
+func notLeader(err error) (*store.NotLeaderError, bool) {
+	var nle *store.NotLeaderError
+	if errors.As(err, &nle) {
+		return nle, true
+	}
+	return nil, false
+}
+
+// writeNotLeader tells the client which node to send the request to.
+func writeNotLeader(w http.ResponseWriter, nle *store.NotLeaderError) {
+	body := struct {
+		Error string `json:"error"`
+		*store.NotLeaderError
+	}{
+		Error:          store.ErrNotLeader.Error(),
+		NotLeaderError: nle,
+	}
+	w.Header().Set(leaderHeader, nle.LeaderAPIAddr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(body)
+}
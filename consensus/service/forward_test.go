@@ -0,0 +1,205 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raestrada/sappers/consensus/store"
+)
+
+// followerStore is a Store of a follower: writes fail with a not-leader error
+// naming the leader it knows of. Other methods are not implemented.
+type followerStore struct {
+	Store
+
+	mu     sync.Mutex
+	leader string // API address of the leader, set by tests.
+}
+
+func (f *followerStore) setLeader(addr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.leader = addr
+}
+
+func (f *followerStore) LeaderAPIAddr() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.leader
+}
+
+func (f *followerStore) Set(string, []byte) error {
+	return &store.NotLeaderError{LeaderID: "node0", LeaderAPIAddr: f.LeaderAPIAddr()}
+}
+
+func (f *followerStore) ApplyTimeout() time.Duration {
+	return time.Second
+}
+
+// fakeLeader serves the HTTP API of a leader with handler, and counts the
+// requests it gets.
+type fakeLeader struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests int
+}
+
+func newFakeLeader(t *testing.T, handler http.HandlerFunc) *fakeLeader {
+	l := &fakeLeader{}
+	l.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.mu.Lock()
+		l.requests++
+		l.mu.Unlock()
+		handler(w, r)
+	}))
+	t.Cleanup(l.Close)
+	return l
+}
+
+func (l *fakeLeader) addr() string {
+	return strings.TrimPrefix(l.URL, "http://")
+}
+
+func (l *fakeLeader) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.requests
+}
+
+// deadAddr returns an address nothing listens on.
+func deadAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// putKey sends a PUT of a value to the service at url.
+func putKey(t *testing.T, url string, body []byte) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest("PUT", url+"/key/a", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestForward(t *testing.T) {
+	var got []byte
+	var forwarded string
+	leader := newFakeLeader(t, func(w http.ResponseWriter, r *http.Request) {
+		got, _ = io.ReadAll(r.Body)
+		forwarded = r.Header.Get(forwardedHeader)
+		w.Header().Set("X-Test", "leader")
+		w.WriteHeader(http.StatusCreated)
+	})
+	follower := &followerStore{leader: leader.addr()}
+	srv := httptest.NewServer(New("", follower))
+	defer srv.Close()
+
+	body := []byte(`{"value":"MQ=="}`)
+	resp := putKey(t, srv.URL, body)
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("X-Test") != "leader" {
+		t.Fatalf("got %s with headers %v, want the response of the leader", resp.Status, resp.Header)
+	}
+	if !bytes.Equal(got, body) || forwarded == "" {
+		t.Fatalf("leader got %q, forwarded %q", got, forwarded)
+	}
+}
+
+func TestForwardRetriesDial(t *testing.T) {
+	leader := newFakeLeader(t, func(w http.ResponseWriter, r *http.Request) {})
+	// The follower first names a leader that is gone, and learns of the new
+	// one by the time it retries.
+	follower := &followerStore{leader: deadAddr(t)}
+	srv := httptest.NewServer(New("", follower))
+	defer srv.Close()
+	time.AfterFunc(forwardRetryDelay/2, func() { follower.setLeader(leader.addr()) })
+
+	if resp := putKey(t, srv.URL, []byte(`{"value":"MQ=="}`)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %s, want 200", resp.Status)
+	}
+	if n := leader.count(); n != 1 {
+		t.Fatalf("leader got %d requests, want 1", n)
+	}
+}
+
+func TestForwardGivesUp(t *testing.T) {
+	// The node reached keeps answering that it no longer leads.
+	leader := newFakeLeader(t, func(w http.ResponseWriter, r *http.Request) {
+		writeNotLeader(w, &store.NotLeaderError{})
+	})
+	follower := &followerStore{leader: leader.addr()}
+	srv := httptest.NewServer(New("", follower))
+	defer srv.Close()
+
+	resp := putKey(t, srv.URL, []byte(`{"value":"MQ=="}`))
+	if n := leader.count(); n != maxForwardAttempts {
+		t.Fatalf("leader got %d requests, want %d", n, maxForwardAttempts)
+	}
+	checkNotLeader(t, resp, leader.addr())
+}
+
+func TestNoForward(t *testing.T) {
+	leader := newFakeLeader(t, func(w http.ResponseWriter, r *http.Request) {})
+	svc := New("", &followerStore{leader: leader.addr()})
+	svc.Forward = false
+	srv := httptest.NewServer(svc)
+	defer srv.Close()
+
+	checkNotLeader(t, putKey(t, srv.URL, []byte(`{"value":"MQ=="}`)), leader.addr())
+	if n := leader.count(); n != 0 {
+		t.Fatalf("leader got %d requests with forwarding disabled", n)
+	}
+}
+
+func TestForwardBodyLimit(t *testing.T) {
+	leader := newFakeLeader(t, func(w http.ResponseWriter, r *http.Request) {})
+	srv := httptest.NewServer(New("", &followerStore{leader: leader.addr()}))
+	defer srv.Close()
+
+	if resp := putKey(t, srv.URL, make([]byte, maxBufferedBody+1)); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got %s, want 413", resp.Status)
+	}
+	if n := leader.count(); n != 0 {
+		t.Fatalf("leader got %d requests for a body too large", n)
+	}
+}
+
+// checkNotLeader checks that resp is a not-leader response naming leader.
+func checkNotLeader(t *testing.T, resp *http.Response, leader string) {
+	t.Helper()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got %s, want 503", resp.Status)
+	}
+	if got := resp.Header.Get(leaderHeader); got != leader {
+		t.Fatalf("%s header is %q, want %q", leaderHeader, got, leader)
+	}
+	var body struct {
+		Error         string `json:"error"`
+		LeaderAPIAddr string `json:"leader_api_addr"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error != store.ErrNotLeader.Error() || body.LeaderAPIAddr != leader {
+		t.Fatalf("body is %+v, want the not-leader error naming %s", body, leader)
+	}
+}
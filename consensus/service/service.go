@@ -4,42 +4,167 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/raestrada/sappers/consensus/store"
 	"go.uber.org/zap"
 )
 
 // Store is the interface Raft-backed key-value stores must implement.
 type Store interface {
-	// Get returns the value for the given key.
-	Get(key string) (string, error)
+	// Get returns the entry for the given key, served with the freshness
+	// guarantees requested in opts. It returns nil if the key does not exist.
+	Get(key string, opts store.ReadOptions) (*store.KeyValue, error)
 
 	// Set sets the value for the given key, via distributed consensus.
-	Set(key, value string) error
+	Set(key string, value []byte) error
 
 	// Delete removes the given key, via distributed consensus.
 	Delete(key string) error
 
+	// CompareAndSwap sets the value for the given key only if it currently
+	// holds expected.
+	CompareAndSwap(key string, expected, value []byte) error
+
+	// CompareAndSwapRevision sets the value for the given key only if its
+	// mod revision is revision.
+	CompareAndSwapRevision(key string, revision uint64, value []byte) error
+
+	// Create sets the value for the given key only if it does not exist.
+	Create(key string, value []byte) error
+
+	// Update sets the value for the given key only if it already exists.
+	Update(key string, value []byte) error
+
+	// SetWithLease sets the value for the given key and attaches it to a lease.
+	SetWithLease(key string, value []byte, lease int64) error
+
+	// Grant creates a lease with the given TTL.
+	Grant(ttl time.Duration) (*store.Lease, error)
+
+	// Revoke deletes a lease and every key attached to it.
+	Revoke(id int64) error
+
+	// KeepAlive renews a lease for another TTL.
+	KeepAlive(id int64) (*store.Lease, error)
+
+	// TimeToLive returns the status of a lease.
+	TimeToLive(id int64) (*store.LeaseStatus, error)
+
+	// Txn applies a transaction atomically.
+	Txn(t *store.Txn) (*store.TxnResult, error)
+
+	// List returns a page of entries in key order.
+	List(opts store.ListOptions) (*store.ListResult, error)
+
+	// Watch returns a watcher for a key or a key prefix, optionally resuming
+	// from a past revision.
+	Watch(key string, prefix bool, rev uint64) (*store.Watcher, error)
+
 	// Join joins the node, identitifed by nodeID and reachable at addr, to the cluster.
-	Join(nodeID string, addr string) error
+	// meta is what the node publishes about itself, such as its HTTP API address.
+	Join(nodeID, addr string, meta store.NodeMeta) error
+
+	// LeaderAPIAddr returns the HTTP API address of the current leader.
+	LeaderAPIAddr() string
+
+	// ApplyTimeout returns how long a write waits to be added to the log.
+	ApplyTimeout() time.Duration
+
+	// Snapshot takes a snapshot of this node now and returns its metadata.
+	Snapshot() (*store.SnapshotMeta, error)
+
+	// LatestSnapshot opens the most recent snapshot of this node.
+	LatestSnapshot() (*store.SnapshotMeta, io.ReadCloser, error)
+
+	// RestoreSnapshot replaces the state of the cluster with a snapshot.
+	RestoreSnapshot(r io.Reader) error
+
+	// SetNamespace creates a namespace or changes its limits.
+	SetNamespace(name string, limits store.NamespaceLimits) error
+
+	// DeleteNamespace removes the limits of a namespace, keeping its keys.
+	DeleteNamespace(name string) error
+
+	// Namespace returns the limits and usage of a namespace.
+	Namespace(name string) (*store.NamespaceStatus, error)
+
+	// Namespaces returns the limits and usage of every namespace.
+	Namespaces() []*store.NamespaceStatus
+
+	// Status returns the status of this node.
+	Status() *store.Status
+
+	// Servers returns the members of the Raft configuration.
+	Servers() ([]store.Server, error)
+
+	// RemoveServer removes a server from the Raft configuration.
+	RemoveServer(id string) error
+
+	// DemoteVoter makes a voter a non-voter.
+	DemoteVoter(id string) error
+
+	// TransferLeadership hands leadership over to the voter id, or to the
+	// most up-to-date voter if id is empty.
+	TransferLeadership(id string) error
 }
 
+// joinRequest is the body of a join. Only the ID and the Raft address are
+// required; nodes that predate them send no API address or ops.
+type joinRequest struct {
+	ID             string   `json:"id"`
+	Addr           string   `json:"addr"`
+	APIAddr        string   `json:"api_addr"`
+	CommandVersion uint64   `json:"command_version"`
+	Ops            []string `json:"ops"`
+}
+
+// errLeaseWithCondition is returned when a write asks for both a lease and a
+// condition, which the store does not support in a single operation.
+var errLeaseWithCondition = errors.New("lease cannot be combined with a condition")
+
 // Service provides HTTP service.
 type Service struct {
 	addr string
 	ln   net.Listener
 
 	store Store
+
+	// Forward sends the requests that must run on the leader, such as
+	// writes, to the leader when they reach a follower. When disabled those
+	// requests fail with 503 and the address of the leader.
+	Forward bool
+
+	// Members, if set, returns the gossip member list reported by /status.
+	Members func() []Member
+}
+
+// Member is a node of the gossip member list.
+type Member struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+}
+
+// statusResponse is the body of GET /status.
+type statusResponse struct {
+	*store.Status
+	Members []Member `json:"members,omitempty"`
 }
 
 // New returns an uninitialized HTTP service.
 func New(addr string, store Store) *Service {
 	return &Service{
-		addr:  addr,
-		store: store,
+		addr:    addr,
+		store:   store,
+		Forward: true,
 	}
 }
 
@@ -80,52 +205,84 @@ func (s *Service) Close() {
 
 // ServeHTTP allows Service to serve HTTP requests.
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if strings.HasPrefix(r.URL.Path, "/key") {
+	// Snapshot uploads can be large, so they are streamed rather than
+	// buffered for forwarding.
+	if s.Forward && r.Method != "GET" && r.URL.Path != "/snapshot/restore" {
+		if err := bufferBody(w, r); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			return
+		}
+	}
+
+	if r.URL.Path == "/keys" {
+		s.handleList(w, r)
+	} else if strings.HasPrefix(r.URL.Path, "/key") {
 		s.handleKeyRequest(w, r)
+	} else if strings.HasPrefix(r.URL.Path, "/watch/") {
+		s.handleWatch(w, r)
+	} else if strings.HasPrefix(r.URL.Path, "/lease") {
+		s.handleLeaseRequest(w, r)
+	} else if r.URL.Path == "/txn" {
+		s.handleTxn(w, r)
 	} else if r.URL.Path == "/join" {
 		s.handleJoin(w, r)
+	} else if r.URL.Path == "/status" {
+		s.handleStatus(w, r)
+	} else if strings.HasPrefix(r.URL.Path, "/snapshot") {
+		s.handleSnapshotRequest(w, r)
+	} else if r.URL.Path == "/namespaces" || strings.HasPrefix(r.URL.Path, "/namespace/") {
+		s.handleNamespaceRequest(w, r)
+	} else if r.URL.Path == "/servers" || strings.HasPrefix(r.URL.Path, "/server/") {
+		s.handleServerRequest(w, r)
+	} else if r.URL.Path == "/leadership/transfer" {
+		s.handleTransferLeadership(w, r)
 	} else {
 		w.WriteHeader(http.StatusNotFound)
 	}
 }
 
 func (s *Service) handleJoin(w http.ResponseWriter, r *http.Request) {
-	m := map[string]string{}
+	m := joinRequest{}
 	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	if len(m) != 2 {
+	if m.Addr == "" || m.ID == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	remoteAddr, ok := m["addr"]
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
+	meta := store.NodeMeta{
+		APIAddr:        m.APIAddr,
+		CommandVersion: m.CommandVersion,
+		Ops:            m.Ops,
+	}
+	if err := s.store.Join(m.ID, m.Addr, meta); err != nil {
+		s.writeError(w, r, err)
 		return
 	}
+}
 
-	nodeID, ok := m["id"]
+func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
+	ns, ok := requestNamespace(r)
 	if !ok {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	if err := s.store.Join(nodeID, remoteAddr); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-}
-
-func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
+	// Keys may contain slashes, e.g. /key/services/web/instances/1.
 	getKey := func() string {
-		parts := strings.Split(r.URL.Path, "/")
-		if len(parts) != 3 {
+		k := strings.TrimPrefix(r.URL.Path, "/key/")
+		if !strings.HasPrefix(r.URL.Path, "/key/") || k == "" {
 			return ""
 		}
-		return parts[2]
+		return store.NamespaceKey(ns, k)
 	}
 
 	switch r.Method {
@@ -133,14 +290,39 @@ func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 		k := getKey()
 		if k == "" {
 			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		opts, err := readOptions(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
-		v, err := s.store.Get(k)
+		kv, err := s.store.Get(k, opts)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			s.writeError(w, r, err)
+			return
+		}
+		if kv == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// With ?raw=true the value is the body and the metadata is sent as
+		// headers. Otherwise the entry is JSON, with a base64 value.
+		if r.URL.Query().Get("raw") == "true" {
+			h := w.Header()
+			h.Set("Content-Type", "application/octet-stream")
+			h.Set("X-Sappers-Create-Revision", strconv.FormatUint(kv.CreateRevision, 10))
+			h.Set("X-Sappers-Mod-Revision", strconv.FormatUint(kv.ModRevision, 10))
+			h.Set("X-Sappers-Version", strconv.FormatUint(kv.Version, 10))
+			if kv.Lease != 0 {
+				h.Set("X-Sappers-Lease", strconv.FormatInt(kv.Lease, 10))
+			}
+			w.Write(kv.Value)
 			return
 		}
 
-		b, err := json.Marshal(map[string]string{k: v})
+		b, err := json.Marshal(unscope(ns, kv))
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
@@ -149,17 +331,48 @@ func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 		io.WriteString(w, string(b))
 
 	case "POST":
-		// Read the value from the POST body.
-		m := map[string]string{}
+		// Read the values from the POST body and write them all at once.
+		// Values are base64 encoded, as GET returns them.
+		m := map[string][]byte{}
 		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		for k, v := range m {
-			if err := s.store.Set(k, v); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		txn := &store.Txn{}
+		for _, k := range keys {
+			txn.Success = append(txn.Success, store.TxnOp{Type: store.TxnPut, Key: store.NamespaceKey(ns, k), Value: m[k]})
+		}
+		if _, err := s.store.Txn(txn); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+	case "PUT":
+		k := getKey()
+		if k == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var req writeRequest
+		var err error
+		if r.Header.Get("Content-Type") == "application/octet-stream" {
+			req, err = rawWriteRequest(r)
+		} else {
+			err = json.NewDecoder(r.Body).Decode(&req)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := s.write(k, req); err != nil {
+			s.writeError(w, r, err)
+			return
 		}
 
 	case "DELETE":
@@ -169,10 +382,9 @@ func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if err := s.store.Delete(k); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			s.writeError(w, r, err)
 			return
 		}
-		s.store.Delete(k)
 
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -180,6 +392,634 @@ func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// writeRequest is the body of a PUT on a key. Without conditions it behaves
+// like a plain set. PrevValue or PrevRevision turn it into a compare-and-swap,
+// PrevExist false into a create-only write and PrevExist true into an
+// update-only write. Values are base64 encoded.
+type writeRequest struct {
+	Value        []byte  `json:"value"`
+	PrevValue    []byte  `json:"prev_value,omitempty"`
+	PrevRevision *uint64 `json:"prev_revision,omitempty"`
+	PrevExist    *bool   `json:"prev_exist,omitempty"`
+	Lease        int64   `json:"lease,omitempty"`
+}
+
+// rawWriteRequest builds the writeRequest of a PUT whose body is the raw
+// value. The conditions are then given as the query parameters prev_value,
+// prev_revision, prev_exist and lease.
+func rawWriteRequest(r *http.Request) (writeRequest, error) {
+	req := writeRequest{}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return req, err
+	}
+	req.Value = b
+
+	q := r.URL.Query()
+	if q.Has("prev_value") {
+		req.PrevValue = []byte(q.Get("prev_value"))
+	}
+	if v := q.Get("prev_revision"); v != "" {
+		rev, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return req, err
+		}
+		req.PrevRevision = &rev
+	}
+	if v := q.Get("prev_exist"); v != "" {
+		exist, err := strconv.ParseBool(v)
+		if err != nil {
+			return req, err
+		}
+		req.PrevExist = &exist
+	}
+	if v := q.Get("lease"); v != "" {
+		if req.Lease, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return req, err
+		}
+	}
+	return req, nil
+}
+
+// write dispatches a single-key write to the matching store operation.
+func (s *Service) write(key string, req writeRequest) error {
+	conditional := req.PrevRevision != nil || req.PrevValue != nil || req.PrevExist != nil
+	if conditional && req.Lease != 0 {
+		return errLeaseWithCondition
+	}
+
+	switch {
+	case req.Lease != 0:
+		return s.store.SetWithLease(key, req.Value, req.Lease)
+	case req.PrevRevision != nil:
+		return s.store.CompareAndSwapRevision(key, *req.PrevRevision, req.Value)
+	case req.PrevValue != nil:
+		return s.store.CompareAndSwap(key, req.PrevValue, req.Value)
+	case req.PrevExist != nil && *req.PrevExist:
+		return s.store.Update(key, req.Value)
+	case req.PrevExist != nil:
+		return s.store.Create(key, req.Value)
+	default:
+		return s.store.Set(key, req.Value)
+	}
+}
+
+// handleLeaseRequest serves the lease API:
+//
+//	POST   /lease                 grant a lease, body {"ttl": <seconds>}
+//	GET    /lease/<id>            lease status and attached keys
+//	POST   /lease/<id>/keepalive  renew the lease
+//	DELETE /lease/<id>            revoke the lease and delete its keys
+func (s *Service) handleLeaseRequest(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	if len(parts) == 1 {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		m := map[string]int64{}
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		l, err := s.store.Grant(time.Duration(m["ttl"]) * time.Second)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		writeJSON(w, l)
+		return
+	}
+
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || len(parts) > 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case len(parts) == 3 && parts[2] == "keepalive" && r.Method == "POST":
+		l, err := s.store.KeepAlive(id)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		writeJSON(w, l)
+
+	case len(parts) == 2 && r.Method == "GET":
+		status, err := s.store.TimeToLive(id)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		writeJSON(w, status)
+
+	case len(parts) == 2 && r.Method == "DELETE":
+		if err := s.store.Revoke(id); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+//	POST /snapshot          take a snapshot of this node and return its metadata
+//	GET  /snapshot          download the latest snapshot of this node
+//	POST /snapshot/restore  restore the cluster from the snapshot in the body
+//
+// Restores must be sent to the leader. They are not forwarded, a follower
+// answers 503 with the address of the leader.
+func (s *Service) handleSnapshotRequest(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/snapshot" && r.Method == "POST":
+		meta, err := s.store.Snapshot()
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		writeJSON(w, meta)
+
+	case r.URL.Path == "/snapshot" && r.Method == "GET":
+		meta, rc, err := s.store.LatestSnapshot()
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		defer rc.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+		w.Header().Set("X-Raft-Snapshot-Id", meta.ID)
+		w.Header().Set("X-Raft-Term", strconv.FormatUint(meta.Term, 10))
+		w.Header().Set("X-Raft-Index", strconv.FormatUint(meta.Index, 10))
+		io.Copy(w, rc)
+
+	case r.URL.Path == "/snapshot/restore" && r.Method == "POST":
+		if err := s.store.RestoreSnapshot(r.Body); err != nil {
+			if nle, ok := notLeader(err); ok {
+				writeNotLeader(w, nle)
+				return
+			}
+			s.writeError(w, r, err)
+			return
+		}
+
+	case r.URL.Path == "/snapshot" || r.URL.Path == "/snapshot/restore":
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// handleStatus returns the status of this node: its Raft state, indexes and
+// statistics, the Raft configuration and tuning, and the gossip members.
+func (s *Service) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	resp := statusResponse{Status: s.store.Status()}
+	if s.Members != nil {
+		resp.Members = s.Members()
+	}
+	writeJSON(w, resp)
+}
+
+// statusClient fetches the status of other nodes. Its timeout keeps an
+// unresponsive node from holding up the leader.
+var statusClient = &http.Client{Timeout: 2 * time.Second}
+
+// FetchStatus returns the status served by the HTTP API at addr. It is meant
+// as the StatusOf of a store.Store.
+func FetchStatus(addr string) (*store.Status, error) {
+	resp, err := statusClient.Get(fmt.Sprintf("http://%s/status", addr))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status of %s: %s", addr, resp.Status)
+	}
+	var status store.Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// RemoveServer asks the HTTP API at addr to remove the server id from the
+// Raft configuration. A node uses it to leave the cluster through the
+// leader. timeout bounds the request.
+func RemoveServer(addr, id string, timeout time.Duration) error {
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s/server/%s", addr, id), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return store.ErrServerNotFound
+	default:
+		return fmt.Errorf("removing %s through %s: %s", id, addr, resp.Status)
+	}
+}
+
+// handleTxn applies the transaction in the body of a POST and returns
+// whether its comparisons succeeded.
+func (s *Service) handleTxn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ns, ok := requestNamespace(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	txn := &store.Txn{}
+	if err := json.NewDecoder(r.Body).Decode(txn); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for i := range txn.Compare {
+		txn.Compare[i].Key = store.NamespaceKey(ns, txn.Compare[i].Key)
+	}
+	for _, ops := range [][]store.TxnOp{txn.Success, txn.Failure} {
+		for i := range ops {
+			ops[i].Key = store.NamespaceKey(ns, ops[i].Key)
+		}
+	}
+	res, err := s.store.Txn(txn)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	writeJSON(w, res)
+}
+
+// handleList serves a page of keys in key order:
+//
+//	GET /keys?prefix=<p>&start=<k>&end=<k>&limit=<n>&continue=<token>
+//
+// Every parameter is optional. The consistency and namespace parameters of a
+// key read are accepted too.
+func (s *Service) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	read, err := readOptions(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ns, ok := requestNamespace(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	opts := store.ListOptions{
+		Prefix:   store.NamespaceKey(ns, q.Get("prefix")),
+		Start:    q.Get("start"),
+		End:      q.Get("end"),
+		Continue: q.Get("continue"),
+		Read:     read,
+	}
+	if opts.Start != "" {
+		opts.Start = store.NamespaceKey(ns, opts.Start)
+	}
+	if opts.End != "" {
+		opts.End = store.NamespaceKey(ns, opts.End)
+	}
+	if v := q.Get("limit"); v != "" {
+		if opts.Limit, err = strconv.Atoi(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	res, err := s.store.List(opts)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	for i, kv := range res.Items {
+		res.Items[i] = unscope(ns, kv)
+	}
+	writeJSON(w, res)
+}
+
+// handleWatch streams the changes to a key as newline-delimited JSON events:
+//
+//	GET /watch/<key>[?prefix=true][&rev=<revision>][&ns=<namespace>]
+//
+// With prefix set every key starting with <key> is watched, and rev resumes
+// from a past revision. The stream ends with an {"error": ...} line when the
+// store ends the watch, e.g. because the client fell behind.
+func (s *Service) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ns, ok := requestNamespace(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	prefix := q.Get("prefix") == "true"
+	var rev uint64
+	if v := q.Get("rev"); v != "" {
+		var err error
+		if rev, err = strconv.ParseUint(v, 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/watch/")
+	if key == "" && !prefix {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	watcher, err := s.store.Watch(store.NamespaceKey(ns, key), prefix, rev)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	defer watcher.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case ev, ok := <-watcher.Events():
+			if !ok {
+				enc.Encode(map[string]string{"error": watcher.Err().Error()})
+				return
+			}
+			if ns != "" {
+				ev.Key = strings.TrimPrefix(ev.Key, ns+store.NamespaceSeparator)
+				ev.KV = unscope(ns, ev.KV)
+			}
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// handleNamespaceRequest serves the namespace API:
+//
+//	GET    /namespaces        limits and usage of every namespace
+//	GET    /namespace/<name>  limits and usage of a namespace
+//	PUT    /namespace/<name>  create a namespace or change its limits, body
+//	                          {"max_keys": <n>, "max_bytes": <n>, "max_value_size": <n>}
+//	DELETE /namespace/<name>  remove the limits of a namespace, keeping its keys
+//
+// The keys of a namespace are read and written through the key, list, watch
+// and transaction endpoints with the ?ns=<name> query parameter. Usage is
+// read from this node, so a follower may report it slightly behind.
+func (s *Service) handleNamespaceRequest(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/namespaces" {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, s.store.Namespaces())
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/namespace/")
+	if !store.ValidNamespace(name) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		status, err := s.store.Namespace(name)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		writeJSON(w, status)
+
+	case "PUT":
+		limits := store.NamespaceLimits{}
+		if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := s.store.SetNamespace(name, limits); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+	case "DELETE":
+		if err := s.store.DeleteNamespace(name); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleServerRequest lists the members of the Raft configuration, removes
+// one with DELETE /server/<id>, or demotes one with POST
+// /server/<id>/demote.
+func (s *Service) handleServerRequest(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/servers" {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		servers, err := s.store.Servers()
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		writeJSON(w, servers)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/server/")
+	demote := strings.HasSuffix(id, "/demote")
+	id = strings.TrimSuffix(id, "/demote")
+	if id == "" || strings.Contains(id, "/") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch {
+	case demote && r.Method == "POST":
+		err = s.store.DemoteVoter(id)
+	case !demote && r.Method == "DELETE":
+		err = s.store.RemoveServer(id)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, err)
+	}
+}
+
+// handleTransferLeadership hands leadership over to the voter named by the
+// "to" query parameter, or to the most up-to-date voter without one.
+func (s *Service) handleTransferLeadership(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.store.TransferLeadership(r.URL.Query().Get("to")); err != nil {
+		s.writeError(w, r, err)
+	}
+}
+
+// requestNamespace returns the namespace of a request, given by its "ns"
+// query parameter, and whether it is a valid name. Requests without one
+// address the keys outside namespaces.
+func requestNamespace(r *http.Request) (string, bool) {
+	ns := r.URL.Query().Get("ns")
+	return ns, ns == "" || store.ValidNamespace(ns)
+}
+
+// unscope returns a copy of kv with the key relative to namespace ns.
+func unscope(ns string, kv *store.KeyValue) *store.KeyValue {
+	if ns == "" || kv == nil {
+		return kv
+	}
+	c := *kv
+	c.Key = strings.TrimPrefix(c.Key, ns+store.NamespaceSeparator)
+	return &c
+}
+
+// writeJSON writes v as the JSON body of a successful response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// writeError writes the response for a failed operation. Conflicts carry
+// their details as a JSON body. Requests that must run on the leader are
+// forwarded to it, unless forwarding is disabled or they were forwarded
+// already.
+func (s *Service) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	if nle, ok := notLeader(err); ok {
+		if s.Forward && r.Header.Get(forwardedHeader) == "" {
+			s.forward(w, r, nle)
+			return
+		}
+		writeNotLeader(w, nle)
+		return
+	}
+
+	if conflict, ok := err.(*store.ConflictError); ok {
+		b, err := json.Marshal(conflict)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		w.Write(b)
+		return
+	}
+	var quota *store.QuotaError
+	if errors.As(err, &quota) {
+		b, err := json.Marshal(quota)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInsufficientStorage)
+		w.Write(b)
+		return
+	}
+	w.WriteHeader(statusForError(err))
+}
+
+// readOptions builds the read options of a request from its "consistency"
+// and "max_lag" query parameters, e.g. ?consistency=stale&max_lag=2s.
+func readOptions(r *http.Request) (store.ReadOptions, error) {
+	q := r.URL.Query()
+
+	lvl, err := store.ParseReadConsistency(q.Get("consistency"))
+	if err != nil {
+		return store.ReadOptions{}, err
+	}
+	opts := store.ReadOptions{Consistency: lvl}
+
+	if v := q.Get("max_lag"); v != "" {
+		lag, err := time.ParseDuration(v)
+		if err != nil {
+			return store.ReadOptions{}, err
+		}
+		opts.MaxLag = lag
+	}
+	return opts, nil
+}
+
+// statusForError maps a store error to the HTTP status returned to clients.
+func statusForError(err error) int {
+	switch {
+	case errors.Is(err, store.ErrNotLeader), err == store.ErrStaleRead, errors.Is(err, store.ErrUnsupportedCommand):
+		return http.StatusServiceUnavailable
+	case err == store.ErrLeaseNotFound, err == store.ErrNoSnapshot, err == store.ErrNamespaceNotFound, err == store.ErrServerNotFound:
+		return http.StatusNotFound
+	case err == store.ErrLastVoter, err == store.ErrNoTransferTarget:
+		return http.StatusConflict
+	case err == store.ErrCompacted:
+		return http.StatusGone
+	case err == store.ErrInvalidTTL, err == store.ErrInvalidContinue, err == errLeaseWithCondition, err == store.ErrNotVoter:
+		return http.StatusBadRequest
+	case errors.Is(err, store.ErrInvalidTxn), errors.Is(err, store.ErrCorruptSnapshot), errors.Is(err, store.ErrInvalidNamespace):
+		return http.StatusBadRequest
+	case errors.Is(err, store.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 // Addr returns the address on which the Service is listening
 func (s *Service) Addr() net.Addr {
 	return s.ln.Addr()
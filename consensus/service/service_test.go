@@ -0,0 +1,309 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/raestrada/sappers/consensus/store"
+	"github.com/raestrada/sappers/consensus/store/storetest"
+)
+
+// readStore is a Store whose reads fail with err, recording the options
+// they were asked with. Other methods are not implemented.
+type readStore struct {
+	Store
+
+	opts store.ReadOptions
+	err  error
+}
+
+func (s *readStore) Get(key string, opts store.ReadOptions) (*store.KeyValue, error) {
+	s.opts = opts
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &store.KeyValue{Key: key, Value: []byte("v")}, nil
+}
+
+func (s *readStore) LeaderAPIAddr() string {
+	return "leader:11000"
+}
+
+func TestReadConsistency(t *testing.T) {
+	for _, tc := range []struct {
+		query  string
+		err    error
+		status int
+		opts   store.ReadOptions
+	}{
+		{"", nil, http.StatusOK, store.ReadOptions{}},
+		{"?consistency=stale&max_lag=2s", nil, http.StatusOK, store.ReadOptions{Consistency: store.ReadStale, MaxLag: 2 * time.Second}},
+		{"?consistency=linearizable", nil, http.StatusOK, store.ReadOptions{Consistency: store.ReadLinearizable}},
+		{"?consistency=stale&max_lag=2s", store.ErrStaleRead, http.StatusServiceUnavailable, store.ReadOptions{Consistency: store.ReadStale, MaxLag: 2 * time.Second}},
+		{"?consistency=linearizable", &store.NotLeaderError{LeaderAPIAddr: "leader:11000"}, http.StatusServiceUnavailable, store.ReadOptions{Consistency: store.ReadLinearizable}},
+		{"?consistency=eventual", nil, http.StatusBadRequest, store.ReadOptions{}},
+		{"?consistency=stale&max_lag=soon", nil, http.StatusBadRequest, store.ReadOptions{}},
+	} {
+		st := &readStore{err: tc.err}
+		svc := New("", st)
+		svc.Forward = false
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, httptest.NewRequest("GET", "/key/a"+tc.query, nil))
+		if w.Code != tc.status {
+			t.Errorf("%q with %v: got %d, want %d", tc.query, tc.err, w.Code, tc.status)
+		}
+		if st.opts != tc.opts {
+			t.Errorf("%q: read with %+v, want %+v", tc.query, st.opts, tc.opts)
+		}
+	}
+}
+
+// do sends a request with body to the service at url and returns the
+// response and its body.
+func do(t *testing.T, method, url string, body []byte) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, b
+}
+
+// serve runs the service of the leader of a new single node cluster.
+func serve(t *testing.T) (*store.Store, *httptest.Server) {
+	s := storetest.New(t, 1).Leader().Store
+	srv := httptest.NewServer(New("", s))
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func TestSnapshotEndpoints(t *testing.T) {
+	src, srcSrv := serve(t)
+	for _, key := range []string{"a", "b"} {
+		if err := src.Set(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, body := do(t, "POST", srcSrv.URL+"/snapshot", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("snapshot: got %s", resp.Status)
+	}
+	var meta store.SnapshotMeta
+	if err := json.Unmarshal(body, &meta); err != nil {
+		t.Fatal(err)
+	}
+	resp, data := do(t, "GET", srcSrv.URL+"/snapshot", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("download: got %s", resp.Status)
+	}
+	if resp.Header.Get("X-Raft-Snapshot-Id") != meta.ID || int64(len(data)) != meta.Size {
+		t.Fatalf("downloaded %d bytes of %s, want %d bytes of %s",
+			len(data), resp.Header.Get("X-Raft-Snapshot-Id"), meta.Size, meta.ID)
+	}
+
+	dst, dstSrv := serve(t)
+	if resp, _ := do(t, "GET", dstSrv.URL+"/snapshot", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("download before any snapshot: got %s, want 404", resp.Status)
+	}
+	if err := dst.Set("kept", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupted snapshot is rejected and leaves the cluster as it was.
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	if resp, _ := do(t, "POST", dstSrv.URL+"/snapshot/restore", corrupt); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("restore of a corrupted snapshot: got %s, want 400", resp.Status)
+	}
+	if kv, err := dst.Get("kept", store.ReadOptions{}); err != nil || kv == nil {
+		t.Fatalf("kept lost after a rejected restore: %v", err)
+	}
+
+	if resp, _ := do(t, "POST", dstSrv.URL+"/snapshot/restore", data); resp.StatusCode != http.StatusOK {
+		t.Fatalf("restore: got %s", resp.Status)
+	}
+	for _, key := range []string{"a", "b", "kept"} {
+		got, err := dst.Get(key, store.ReadOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := src.Get(key, store.ReadOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s restored as %+v, want %+v", key, got, want)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	c := storetest.New(t, 1)
+	n := c.Leader()
+	if err := n.Store.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	svc := New("", n.Store)
+	svc.Members = func() []Member { return []Member{{Name: n.ID, Addr: "127.0.0.1:7946"}} }
+	srv := httptest.NewServer(svc)
+	defer srv.Close()
+
+	resp, body := do(t, "GET", srv.URL+"/status", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %s", resp.Status)
+	}
+	var status statusResponse
+	if err := json.Unmarshal(body, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.ID != n.ID || status.State != "Leader" || status.LeaderID != n.ID || status.LeaderAddr != string(n.Addr) {
+		t.Errorf("reported as %s in state %s led by %s at %s, want the leader %s at %s",
+			status.ID, status.State, status.LeaderID, status.LeaderAddr, n.ID, n.Addr)
+	}
+	if status.Term == 0 {
+		t.Error("reported term 0")
+	}
+	rev := n.Store.Revision()
+	if status.Revision != rev || status.AppliedIndex < rev || status.CommitIndex < rev || status.LastIndex < status.CommitIndex {
+		t.Errorf("reported revision %d and indexes last %d, commit %d, applied %d, want revision %d",
+			status.Revision, status.LastIndex, status.CommitIndex, status.AppliedIndex, rev)
+	}
+	if len(status.Servers) != 1 || string(status.Servers[0].ID) != n.ID {
+		t.Errorf("reported servers %+v, want only %s", status.Servers, n.ID)
+	}
+	if status.Tuning != storetest.Tuning {
+		t.Errorf("reported tuning %+v, want %+v", status.Tuning, storetest.Tuning)
+	}
+	if len(status.Members) != 1 || status.Members[0].Name != n.ID {
+		t.Errorf("reported members %+v", status.Members)
+	}
+
+	// Durations are reported as strings.
+	var raw struct {
+		Tuning map[string]interface{} `json:"tuning"`
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := raw.Tuning["heartbeat_timeout"], storetest.Tuning.HeartbeatTimeout.String(); got != want {
+		t.Errorf("heartbeat_timeout reported as %v, want %q", got, want)
+	}
+	if got, want := raw.Tuning["snapshot_threshold"], float64(storetest.Tuning.SnapshotThreshold); got != want {
+		t.Errorf("snapshot_threshold reported as %v, want %v", got, want)
+	}
+}
+
+func TestValueEncodings(t *testing.T) {
+	s, srv := serve(t)
+	value := func(key string) []byte {
+		t.Helper()
+		kv, err := s.Get(key, store.ReadOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kv == nil {
+			return nil
+		}
+		return kv.Value
+	}
+
+	// POST takes base64 values.
+	if resp, _ := do(t, "POST", srv.URL+"/key", []byte(`{"a":"AAEC","b":"/w=="}`)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("post: got %s", resp.Status)
+	}
+	if a, b := value("a"), value("b"); !bytes.Equal(a, []byte{0, 1, 2}) || !bytes.Equal(b, []byte{0xff}) {
+		t.Fatalf("posted values stored as %v and %v", a, b)
+	}
+	if resp, _ := do(t, "POST", srv.URL+"/key", []byte(`{"c":"AAEC","k":"v"}`)); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("post of a plain string: got %s, want 400", resp.Status)
+	}
+	if c := value("c"); c != nil {
+		t.Fatalf("rejected post stored %v", c)
+	}
+	// A string that is valid base64 is stored decoded.
+	if resp, _ := do(t, "POST", srv.URL+"/key", []byte(`{"d":"abcd"}`)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("post: got %s", resp.Status)
+	}
+	if d := value("d"); !bytes.Equal(d, []byte{0x69, 0xb7, 0x1d}) {
+		t.Fatalf("posted abcd stored as %v", d)
+	}
+
+	// GET returns the value base64 encoded, or raw with ?raw=true.
+	resp, body := do(t, "GET", srv.URL+"/key/a", nil)
+	var kv store.KeyValue
+	if err := json.Unmarshal(body, &kv); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !bytes.Contains(body, []byte(`"value":"AAEC"`)) {
+		t.Fatalf("get: got %s with %s", resp.Status, body)
+	}
+	resp, body = do(t, "GET", srv.URL+"/key/a?raw=true", nil)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, []byte{0, 1, 2}) {
+		t.Fatalf("raw get: got %s with %v", resp.Status, body)
+	}
+	for h, want := range map[string]string{
+		"Content-Type":              "application/octet-stream",
+		"X-Sappers-Create-Revision": strconv.FormatUint(kv.CreateRevision, 10),
+		"X-Sappers-Mod-Revision":    strconv.FormatUint(kv.ModRevision, 10),
+		"X-Sappers-Version":         strconv.FormatUint(kv.Version, 10),
+		"X-Sappers-Lease":           "",
+	} {
+		if got := resp.Header.Get(h); got != want {
+			t.Errorf("raw get: %s is %q, want %q", h, got, want)
+		}
+	}
+
+	// PUT takes the raw value as an octet-stream body, with its conditions
+	// in the query.
+	put := func(query string, body []byte) int {
+		t.Helper()
+		req, err := http.NewRequest("PUT", srv.URL+"/key/c"+query, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, tc := range []struct {
+		query  string
+		body   []byte
+		status int
+		value  []byte
+	}{
+		{"?prev_exist=false", []byte{0, 0xff}, http.StatusOK, []byte{0, 0xff}},
+		{"?prev_exist=false", []byte{1}, http.StatusConflict, []byte{0, 0xff}},
+		{"?prev_value=x", []byte{1}, http.StatusConflict, []byte{0, 0xff}},
+		{"?prev_value=%00%FF", []byte("{}"), http.StatusOK, []byte("{}")},
+		{"?lease=soon", []byte{1}, http.StatusBadRequest, []byte("{}")},
+		{"", nil, http.StatusOK, nil},
+	} {
+		if status := put(tc.query, tc.body); status != tc.status {
+			t.Errorf("raw put%s: got %d, want %d", tc.query, status, tc.status)
+		}
+		if got := value("c"); !bytes.Equal(got, tc.value) {
+			t.Errorf("raw put%s: c is %v, want %v", tc.query, got, tc.value)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Backends of the FSM state, selected with Store.Backend.
+const (
+	// BackendMemory keeps the entries in a B-tree in memory.
+	BackendMemory = "memory"
+
+	// BackendBolt keeps the entries in a bolt database in the Raft
+	// directory, so the dataset is not bound by RAM.
+	BackendBolt = "bolt"
+)
+
+const (
+	// boltBackendPattern names the databases of the bolt backend. A new one
+	// is created on open and on every restore.
+	boltBackendPattern = "fsm-*.db"
+
+	// boltMmapSize is the initial memory map of a bolt backend. Growing the
+	// map waits for every read transaction, including the one a snapshot
+	// is persisted from, so it is made large enough to rarely grow.
+	boltMmapSize = 1 << 30
+)
+
+var boltEntriesBucket = []byte("entries")
+
+// ErrUnknownBackend is returned by Open when Store.Backend names no backend.
+var ErrUnknownBackend = errors.New("unknown FSM backend")
+
+// backend stores the entries of the keyspace in key order. Entries are
+// never modified once stored.
+type backend interface {
+	// Get returns the entry for key, or nil if it does not exist.
+	Get(key string) (*KeyValue, error)
+
+	// Ascend calls fn for the entries from key start on, in key order,
+	// until fn returns false.
+	Ascend(start string, fn func(kv *KeyValue) bool) error
+
+	// Update runs fn in a write transaction, which is committed if fn
+	// returns nil and rolled back otherwise. Only one transaction runs at a
+	// time.
+	Update(fn func(tx backendTx) error) error
+
+	// View returns a point-in-time view of the entries, unaffected by later
+	// writes. It must be released once read.
+	View() (backendView, error)
+
+	// Close releases the backend and the resources it holds.
+	Close() error
+}
+
+// backendTx is a write transaction on a backend. Its reads see its own
+// writes.
+type backendTx interface {
+	// Get returns the entry for key, or nil if it does not exist.
+	Get(key string) (*KeyValue, error)
+
+	// Put stores kv, replacing the previous entry for its key.
+	Put(kv *KeyValue) error
+
+	// Delete removes the entry for key and returns it, or nil if it did not
+	// exist.
+	Delete(key string) (*KeyValue, error)
+
+	// Ascend calls fn for the entries from key start on, in key order,
+	// until fn returns false.
+	Ascend(start string, fn func(kv *KeyValue) bool) error
+}
+
+// backendView is a read-only, point-in-time view of a backend.
+type backendView interface {
+	// Len returns the number of entries.
+	Len() int
+
+	// Ascend calls fn for the entries from key start on, in key order,
+	// until fn returns false.
+	Ascend(start string, fn func(kv *KeyValue) bool) error
+
+	// Release releases the view.
+	Release()
+}
+
+// newBackend returns an empty backend of the kind set in s.Backend.
+func (s *Store) newBackend() (backend, error) {
+	switch s.Backend {
+	case "", BackendMemory:
+		return newMemoryBackend(), nil
+	case BackendBolt:
+		return newBoltBackend(s.RaftDir)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownBackend, s.Backend)
+	}
+}
+
+// openBackend replaces the backend of s with an empty one. The FSM state is
+// rebuilt from the snapshots and the log when Raft starts, so the databases
+// left by a previous run are dropped.
+func (s *Store) openBackend() error {
+	if s.Backend == BackendBolt {
+		stale, err := filepath.Glob(filepath.Join(s.RaftDir, boltBackendPattern))
+		if err != nil {
+			return err
+		}
+		for _, path := range stale {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	b, err := s.newBackend()
+	if err != nil {
+		return err
+	}
+	s.m.Close()
+	s.m = b
+	return nil
+}
+
+// memoryBackend keeps the entries in a B-tree. Views are lazy copy-on-write
+// clones of the tree. Its writes cannot fail, so a transaction writes to the
+// tree directly and is not rolled back.
+type memoryBackend struct {
+	tree *keyspace
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{tree: newKeyspace()}
+}
+
+func (m *memoryBackend) Get(key string) (*KeyValue, error) {
+	kv, _ := m.tree.Get(&KeyValue{Key: key})
+	return kv, nil
+}
+
+func (m *memoryBackend) Put(kv *KeyValue) error {
+	m.tree.ReplaceOrInsert(kv)
+	return nil
+}
+
+func (m *memoryBackend) Delete(key string) (*KeyValue, error) {
+	kv, _ := m.tree.Delete(&KeyValue{Key: key})
+	return kv, nil
+}
+
+func (m *memoryBackend) Ascend(start string, fn func(kv *KeyValue) bool) error {
+	m.tree.AscendGreaterOrEqual(&KeyValue{Key: start}, fn)
+	return nil
+}
+
+func (m *memoryBackend) Update(fn func(tx backendTx) error) error {
+	return fn(m)
+}
+
+func (m *memoryBackend) View() (backendView, error) {
+	return &memoryBackend{tree: m.tree.Clone()}, nil
+}
+
+func (m *memoryBackend) Len() int {
+	return m.tree.Len()
+}
+
+func (m *memoryBackend) Release() {}
+
+func (m *memoryBackend) Close() error {
+	return nil
+}
+
+// boltBackend keeps the entries in a bolt database, encoded as snapshot
+// entry records. Views are read transactions. The database is rebuilt from
+// Raft on every start, so it is never synced to disk and it is removed when
+// closed.
+type boltBackend struct {
+	db *bolt.DB
+}
+
+func newBoltBackend(dir string) (*boltBackend, error) {
+	f, err := os.CreateTemp(dir, boltBackendPattern)
+	if err != nil {
+		return nil, err
+	}
+	path := f.Name()
+	f.Close()
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{
+		Timeout:         time.Second,
+		InitialMmapSize: boltMmapSize,
+	})
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("open bolt backend: %s", err)
+	}
+	db.NoSync = true
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltEntriesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return &boltBackend{db: db}, nil
+}
+
+// boltKey returns the database key of key. Bolt rejects empty keys, so
+// every key gets a prefix.
+func boltKey(key string) []byte {
+	return append([]byte{'k'}, key...)
+}
+
+// boltEntry decodes an entry read from the database. The data is only valid
+// during its transaction, so it is copied.
+func boltEntry(v []byte) (*KeyValue, error) {
+	return decodeKeyValue(append([]byte(nil), v...))
+}
+
+func (b *boltBackend) Get(key string) (kv *KeyValue, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		kv, err = (&boltTx{tx: tx}).Get(key)
+		return err
+	})
+	return kv, err
+}
+
+func (b *boltBackend) Ascend(start string, fn func(kv *KeyValue) bool) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return (&boltTx{tx: tx}).Ascend(start, fn)
+	})
+}
+
+func (b *boltBackend) Update(fn func(tx backendTx) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (b *boltBackend) View() (backendView, error) {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &boltView{tx: tx}, nil
+}
+
+func (b *boltBackend) Close() error {
+	path := b.db.Path()
+	if err := b.db.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// boltTx is a transaction on a bolt backend.
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t *boltTx) Get(key string) (*KeyValue, error) {
+	v := t.tx.Bucket(boltEntriesBucket).Get(boltKey(key))
+	if v == nil {
+		return nil, nil
+	}
+	return boltEntry(v)
+}
+
+func (t *boltTx) Put(kv *KeyValue) error {
+	return t.tx.Bucket(boltEntriesBucket).Put(boltKey(kv.Key), encodeKeyValue(kv))
+}
+
+func (t *boltTx) Delete(key string) (*KeyValue, error) {
+	kv, err := t.Get(key)
+	if kv == nil || err != nil {
+		return nil, err
+	}
+	return kv, t.tx.Bucket(boltEntriesBucket).Delete(boltKey(key))
+}
+
+func (t *boltTx) Ascend(start string, fn func(kv *KeyValue) bool) error {
+	c := t.tx.Bucket(boltEntriesBucket).Cursor()
+	for k, v := c.Seek(boltKey(start)); k != nil; k, v = c.Next() {
+		kv, err := boltEntry(v)
+		if err != nil {
+			return err
+		}
+		if !fn(kv) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// boltView is a read transaction on a bolt backend.
+type boltView struct {
+	tx *bolt.Tx
+}
+
+func (v *boltView) Len() int {
+	return v.tx.Bucket(boltEntriesBucket).Stats().KeyN
+}
+
+func (v *boltView) Ascend(start string, fn func(kv *KeyValue) bool) error {
+	return (&boltTx{tx: v.tx}).Ascend(start, fn)
+}
+
+func (v *boltView) Release() {
+	v.tx.Rollback()
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// forEachBackend runs fn against an empty backend of every kind.
+func forEachBackend(t *testing.T, fn func(t *testing.T, b backend)) {
+	for _, kind := range []string{BackendMemory, BackendBolt} {
+		t.Run(kind, func(t *testing.T) {
+			s := &Store{Backend: kind, RaftDir: t.TempDir()}
+			b, err := s.newBackend()
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { b.Close() })
+			fn(t, b)
+		})
+	}
+}
+
+// keysOf returns the keys b holds from start on.
+func keysOf(t *testing.T, b interface {
+	Ascend(string, func(*KeyValue) bool) error
+}, start string) []string {
+	t.Helper()
+	var keys []string
+	err := b.Ascend(start, func(kv *KeyValue) bool {
+		keys = append(keys, kv.Key)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestBackend(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		err := b.Update(func(tx backendTx) error {
+			for _, key := range []string{"c", "a", "b", ""} {
+				if err := tx.Put(&KeyValue{Key: key, Value: []byte("v" + key), ModRevision: 1}); err != nil {
+					return err
+				}
+			}
+			// The transaction reads its own writes.
+			if kv, err := tx.Get("b"); err != nil || kv == nil {
+				return fmt.Errorf("b not visible in its transaction: %v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kv, err := b.Get("a")
+		if err != nil || kv == nil || string(kv.Value) != "va" || kv.ModRevision != 1 {
+			t.Fatalf("a is %+v, %v", kv, err)
+		}
+		if kv, err := b.Get("missing"); err != nil || kv != nil {
+			t.Fatalf("missing key is %+v, %v", kv, err)
+		}
+		if got, want := keysOf(t, b, ""), []string{"", "a", "b", "c"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("keys %q, want %q", got, want)
+		}
+		if got, want := keysOf(t, b, "b"), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("keys from b %q, want %q", got, want)
+		}
+
+		view, err := b.View()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer view.Release()
+
+		err = b.Update(func(tx backendTx) error {
+			prev, err := tx.Delete("a")
+			if err != nil {
+				return err
+			}
+			if prev == nil || string(prev.Value) != "va" {
+				return fmt.Errorf("deleted %+v, want a", prev)
+			}
+			if prev, err := tx.Delete("a"); err != nil || prev != nil {
+				return fmt.Errorf("deleted a twice: %+v, %v", prev, err)
+			}
+			return tx.Put(&KeyValue{Key: "d", Value: []byte("vd")})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := keysOf(t, b, ""), []string{"", "b", "c", "d"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("keys %q, want %q", got, want)
+		}
+		// The view still holds the entries as they were.
+		if view.Len() != 4 {
+			t.Fatalf("view holds %d entries, want 4", view.Len())
+		}
+		if got, want := keysOf(t, view, ""), []string{"", "a", "b", "c"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("view keys %q, want %q", got, want)
+		}
+	})
+}
+
+func TestBoltBackendRollback(t *testing.T) {
+	b, err := newBoltBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	failed := errors.New("failed")
+	err = b.Update(func(tx backendTx) error {
+		if err := tx.Put(&KeyValue{Key: "a"}); err != nil {
+			return err
+		}
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("got %v, want the error of the transaction", err)
+	}
+	if kv, err := b.Get("a"); err != nil || kv != nil {
+		t.Fatalf("write of a rolled back transaction is %+v, %v", kv, err)
+	}
+}
+
+// TestStoreBackends applies the same writes on a store of every backend and
+// checks that they end in the same state, before and after a restore.
+func TestStoreBackends(t *testing.T) {
+	var states [][]KeyValue
+	for _, kind := range []string{BackendMemory, BackendBolt} {
+		t.Run(kind, func(t *testing.T) {
+			s := openTestStore(t, func(s *Store) {
+				s.Backend = kind
+				s.RaftDir = t.TempDir()
+			})
+			l, err := s.Grant(time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// More entries than a restore writes per transaction.
+			for i := 0; i < restoreBatchSize+10; i++ {
+				if err := s.Set(fmt.Sprintf("key%05d", i), []byte("value")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.SetWithLease("leased", []byte("1"), l.ID); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete("key00000"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.CompareAndSwap("key00001", []byte("value"), []byte("swapped")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Txn(&Txn{
+				Compare: []Compare{{Key: "key00002", Target: CompareValue, Result: "=", Value: []byte("value")}},
+				Success: []TxnOp{{Type: TxnPut, Key: "txn", Value: []byte("1")}, {Type: TxnDelete, Key: "key00002"}},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Revoke(l.ID); err != nil {
+				t.Fatal(err)
+			}
+
+			state := dumpStore(t, s)
+			data := snapshotOf(t, s)
+			if err := (*fsm)(s).Restore(io.NopCloser(bytes.NewReader(data))); err != nil {
+				t.Fatal(err)
+			}
+			if restored := dumpStore(t, s); !reflect.DeepEqual(restored, state) {
+				t.Fatalf("restore holds %d entries, want %d", len(restored), len(state))
+			}
+			states = append(states, state)
+		})
+	}
+	if len(states) != 2 || len(states[0]) != len(states[1]) {
+		t.Fatal("the backends hold different entries")
+	}
+	// Revisions depend on the entries Raft appends of its own, so only the
+	// rest is compared.
+	for i, kv := range states[0] {
+		other := states[1][i]
+		if kv.Key != other.Key || !bytes.Equal(kv.Value, other.Value) || kv.Version != other.Version || kv.Lease != other.Lease {
+			t.Fatalf("memory holds %+v, bolt %+v", kv, other)
+		}
+	}
+}
+
+// dumpStore returns every entry of s.
+func dumpStore(t *testing.T, s *Store) []KeyValue {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []KeyValue
+	err := s.m.Ascend("", func(kv *KeyValue) bool {
+		entries = append(entries, *kv)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
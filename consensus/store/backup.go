@@ -0,0 +1,211 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+// ErrNoSnapshot is returned when a node has not taken any snapshot yet.
+var ErrNoSnapshot = errors.New("no snapshot available")
+
+// SnapshotMeta describes a snapshot taken by Raft.
+type SnapshotMeta struct {
+	ID    string `json:"id"`
+	Term  uint64 `json:"term"`
+	Index uint64 `json:"index"`
+	Size  int64  `json:"size"`
+}
+
+func newSnapshotMeta(m *raft.SnapshotMeta) *SnapshotMeta {
+	return &SnapshotMeta{ID: m.ID, Term: m.Term, Index: m.Index, Size: m.Size}
+}
+
+// Snapshot makes Raft take a snapshot of this node now and returns its
+// metadata. If nothing was applied since the last snapshot, that one is
+// returned.
+func (s *Store) Snapshot() (*SnapshotMeta, error) {
+	err := s.raft.Snapshot().Error()
+	if err != nil && !errors.Is(err, raft.ErrNothingNewToSnapshot) {
+		return nil, err
+	}
+
+	meta, rc, err := s.LatestSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	rc.Close()
+	return meta, nil
+}
+
+// LatestSnapshot opens the most recent snapshot of this node. The caller
+// must close the returned reader.
+func (s *Store) LatestSnapshot() (*SnapshotMeta, io.ReadCloser, error) {
+	snapshots, err := s.snapshots.List()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, nil, ErrNoSnapshot
+	}
+
+	meta, rc, err := s.snapshots.Open(snapshots[0].ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newSnapshotMeta(meta), rc, nil
+}
+
+// RestoreSnapshot replaces the state of the cluster with the snapshot read
+// from r. It must run on the leader, which installs the snapshot on the
+// followers. It is meant for disaster recovery into a fresh cluster, as every
+// write since the snapshot was taken is lost.
+func (s *Store) RestoreSnapshot(r io.Reader) error {
+	funcDesc := "store - RestoreSnapshot"
+
+	if !s.isLeader() {
+		return s.notLeader()
+	}
+
+	// Raft needs the size of the snapshot up front, so spool it to disk.
+	f, err := os.CreateTemp(s.RaftDir, "restore-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+
+	// Raft panics when the FSM fails to restore a snapshot, so it is checked
+	// before being handed over.
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := ValidateSnapshot(f); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	zap.L().Warn(
+		funcDesc,
+		zap.String("msg", fmt.Sprintf("restoring cluster state from a %d byte snapshot", size)),
+	)
+	err = s.raft.Restore(&raft.SnapshotMeta{Version: raft.SnapshotVersionMax, Size: size}, f, s.tuning.ApplyTimeout)
+	if err == raft.ErrNotLeader {
+		return s.notLeader()
+	}
+	return err
+}
+
+// ValidateSnapshot reads a snapshot in any supported format and checks that
+// it can be restored.
+func ValidateSnapshot(r io.Reader) error {
+	_, err := checkSnapshot(r)
+	return err
+}
+
+// checkSnapshot reads a snapshot, reporting any failure as ErrCorruptSnapshot.
+func checkSnapshot(r io.Reader) (*fsmState, error) {
+	state, err := readSnapshot(r, nil, 0)
+	if err != nil && !errors.Is(err, ErrCorruptSnapshot) {
+		err = fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+	}
+	return state, err
+}
+
+// Seed writes the snapshot read from r into an empty Raft directory, with a
+// configuration holding only the node nodeID at raftAddr. A node opened on
+// that directory restores the snapshot and elects itself leader, other nodes
+// then join it as usual. Seed refuses a directory that already holds Raft
+// state.
+func Seed(raftDir, nodeID, raftAddr string, r io.Reader) (*SnapshotMeta, error) {
+	if _, err := os.Stat(filepath.Join(raftDir, "raft.db")); err == nil {
+		return nil, fmt.Errorf("%s already holds a Raft log", raftDir)
+	}
+	if err := os.MkdirAll(raftDir, 0700); err != nil {
+		return nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(raftDir, retainSnapshotCount, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("file snapshot store: %s", err)
+	}
+	if existing, err := snapshots.List(); err != nil {
+		return nil, err
+	} else if len(existing) > 0 {
+		return nil, fmt.Errorf("%s already holds snapshots", raftDir)
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", raftAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(raftDir, "seed-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	state, err := checkSnapshot(f)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// The snapshot takes the index of the last entry it holds, so that new
+	// writes keep getting higher revisions.
+	index := state.revision
+	if index == 0 {
+		index = 1
+	}
+	configuration := raft.Configuration{
+		Servers: []raft.Server{
+			{
+				ID:      raft.ServerID(nodeID),
+				Address: raft.ServerAddress(addr.String()),
+			},
+		},
+	}
+	// The transport only encodes the legacy peer list of the snapshot.
+	_, trans := raft.NewInmemTransport(raft.ServerAddress(addr.String()))
+	defer trans.Close()
+	sink, err := snapshots.Create(raft.SnapshotVersionMax, index, 1, configuration, index, trans)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(sink, f); err != nil {
+		sink.Cancel()
+		return nil, err
+	}
+	if err := sink.Close(); err != nil {
+		return nil, err
+	}
+
+	meta, rc, err := snapshots.Open(sink.ID())
+	if err != nil {
+		return nil, err
+	}
+	rc.Close()
+	return newSnapshotMeta(meta), nil
+}
@@ -0,0 +1,167 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// latestSnapshot takes a snapshot of s and returns it as a backup would
+// download it.
+func latestSnapshot(t *testing.T, s *Store) []byte {
+	t.Helper()
+	if _, err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	_, rc, err := s.LatestSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	src := openTestStore(t)
+	l, err := src.Grant(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b/1", "b/2"} {
+		if err := src.Set(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.SetWithLease("leased", []byte("1"), l.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Set("a", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	data := latestSnapshot(t, src)
+
+	dst := openTestStore(t)
+	if err := dst.Set("gone", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.RestoreSnapshot(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dumpStore(t, dst), dumpStore(t, src); !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored %+v, want %+v", got, want)
+	}
+	// The leader of src may have applied more entries since the snapshot.
+	st, err := readSnapshot(bytes.NewReader(data), newMemoryBackend(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst.Revision() != st.revision {
+		t.Fatalf("revision %d, want the snapshot revision %d", dst.Revision(), st.revision)
+	}
+	if _, err := dst.TimeToLive(l.ID); err != nil {
+		t.Fatalf("lease not restored: %v", err)
+	}
+
+	// The restored store keeps accepting writes.
+	if err := dst.Set("c", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreCorruptSnapshot(t *testing.T) {
+	src := openTestStore(t)
+	if err := src.Set("a", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	data := latestSnapshot(t, src)
+
+	dst := openTestStore(t)
+	if err := dst.Set("kept", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	before := dumpStore(t, dst)
+	for name, b := range map[string][]byte{
+		"flipped value": flip(data, bytes.Index(data, []byte("value"))),
+		"flipped last":  flip(data, len(data)-1),
+		"truncated":     data[:len(data)-3],
+		"empty":         nil,
+	} {
+		if err := dst.RestoreSnapshot(bytes.NewReader(b)); !errors.Is(err, ErrCorruptSnapshot) {
+			t.Errorf("%s: got %v, want ErrCorruptSnapshot", name, err)
+		}
+	}
+	if got := dumpStore(t, dst); !reflect.DeepEqual(got, before) {
+		t.Fatalf("store holds %+v after rejected restores, want %+v", got, before)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	src := openTestStore(t)
+	for _, key := range []string{"a", "b"} {
+		if err := src.Set(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := latestSnapshot(t, src)
+	st, err := readSnapshot(bytes.NewReader(data), newMemoryBackend(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, addr := t.TempDir(), freeAddr(t)
+	if _, err := Seed(dir, "node0", addr, bytes.NewReader(flip(data, len(data)-1))); !errors.Is(err, ErrCorruptSnapshot) {
+		t.Fatalf("seed of a corrupted snapshot: got %v, want ErrCorruptSnapshot", err)
+	}
+	meta, err := Seed(dir, "node0", addr, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Index != st.revision {
+		t.Fatalf("seeded at index %d, want the snapshot revision %d", meta.Index, st.revision)
+	}
+	if _, err := Seed(dir, "node0", addr, bytes.NewReader(data)); err == nil {
+		t.Fatal("seeded a directory that already holds a snapshot")
+	}
+
+	// A node opened on the snapshots of the directory leads a cluster holding
+	// the snapshot. Its log is kept in memory, as raft.db would be empty.
+	s := New(false)
+	s.RaftDir, s.RaftBind = dir, addr
+	s.LogStore, s.StableStore = raft.NewInmemStore(), raft.NewInmemStore()
+	if s.SnapshotStore, err = raft.NewFileSnapshotStore(dir, retainSnapshotCount, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Open(false, "node0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	waitFor(t, 10*time.Second, "a leader", s.isLeader)
+	if got, want := dumpStore(t, s), dumpStore(t, src); !reflect.DeepEqual(got, want) {
+		t.Fatalf("seeded node holds %+v, want %+v", got, want)
+	}
+	if err := s.Set("c", []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if kv, _ := s.Get("c", ReadOptions{}); kv.ModRevision <= st.revision {
+		t.Fatalf("write after seeding got revision %d, not above the snapshot revision %d", kv.ModRevision, st.revision)
+	}
+
+	logDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(logDir, "raft.db"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Seed(logDir, "node0", addr, bytes.NewReader(data)); err == nil {
+		t.Fatal("seeded a directory that already holds a Raft log")
+	}
+}
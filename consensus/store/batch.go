@@ -0,0 +1,193 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Writes are committed in groups. Set, SetWithLease and Delete queue their
+// command, and a single goroutine proposes the queued commands as one
+// "batch" log entry and hands every caller its own result. While a batch
+// commits the next one fills up, so concurrent writers share Raft round
+// trips instead of paying one each. The writes of a batch share the
+// revision of its log entry, as the ops of a transaction do.
+//
+// A batch is proposed once it holds BatchMaxSize commands or maxBatchBytes
+// of keys and values, or BatchDelay after its first command, whichever
+// comes first. The byte bound keeps a batch well within what the followers
+// apply in the apply timeout.
+const maxBatchBytes = 1 << 20
+
+// pendingWrite is a write waiting in the batcher.
+type pendingWrite struct {
+	c    *command
+	done chan error
+}
+
+func (w *pendingWrite) size() int {
+	return len(w.c.Key) + len(w.c.Value)
+}
+
+// write applies a "set" or "delete" command, through the batcher when
+// batching is enabled.
+func (s *Store) write(c *command) error {
+	if s.BatchMaxSize <= 1 {
+		_, err := s.apply(c)
+		return err
+	}
+
+	// Fail early, as apply does, rather than wait for the batch to fail.
+	if !s.isLeader() {
+		return s.notLeader()
+	}
+	if err := s.checkQuota(c); err != nil {
+		return err
+	}
+
+	w := &pendingWrite{c: c, done: make(chan error, 1)}
+	select {
+	case s.batchCh <- w:
+	case <-s.shutdownCh:
+		return raft.ErrRaftShutdown
+	}
+	return <-w.done
+}
+
+// runBatcher proposes the queued writes until the store is closed.
+func (s *Store) runBatcher() {
+	for {
+		select {
+		case w := <-s.batchCh:
+			s.commitBatch(s.collectBatch(w))
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// collectBatch returns a batch starting with first and holding the writes
+// queued until one of the bounds of a batch is reached.
+func (s *Store) collectBatch(first *pendingWrite) []*pendingWrite {
+	batch := []*pendingWrite{first}
+	size := first.size()
+
+	var timeout <-chan time.Time
+	if s.BatchDelay > 0 {
+		timer := time.NewTimer(s.BatchDelay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for len(batch) < s.BatchMaxSize && size < maxBatchBytes {
+		var w *pendingWrite
+		if timeout == nil {
+			select {
+			case w = <-s.batchCh:
+			default:
+				return batch
+			}
+		} else {
+			select {
+			case w = <-s.batchCh:
+			case <-timeout:
+				return batch
+			case <-s.shutdownCh:
+				return batch
+			}
+		}
+		batch = append(batch, w)
+		size += w.size()
+	}
+	return batch
+}
+
+// commitBatch proposes a batch and returns each write its result. Every
+// write was checked against the quotas on its own when it was queued, so
+// the writes that no longer fit with those before them fail here.
+func (s *Store) commitBatch(batch []*pendingWrite) {
+	commands := make([]*command, len(batch))
+	for i, w := range batch {
+		commands[i] = w.c
+	}
+	var fits []*pendingWrite
+	for i, err := range s.checkBatchQuota(commands) {
+		if err != nil {
+			batch[i].done <- err
+			continue
+		}
+		fits = append(fits, batch[i])
+	}
+	batch = fits
+	if len(batch) == 0 {
+		return
+	}
+
+	if len(batch) == 1 {
+		_, err := s.apply(batch[0].c)
+		batch[0].done <- err
+		return
+	}
+
+	c := &command{Op: "batch"}
+	for _, w := range batch {
+		w.c.Version = CommandVersion
+		c.Batch = append(c.Batch, w.c)
+	}
+	resp, err := s.apply(c)
+	if errors.Is(err, ErrUnsupportedCommand) {
+		// Some voter predates batches, so propose the writes one by one.
+		for _, w := range batch {
+			_, err := s.apply(w.c)
+			w.done <- err
+		}
+		return
+	}
+
+	results, ok := resp.([]error)
+	if err == nil && (!ok || len(results) != len(batch)) {
+		err = fmt.Errorf("unexpected response to a batch of %d writes: %v", len(batch), resp)
+	}
+	for i, w := range batch {
+		if err != nil {
+			w.done <- err
+			continue
+		}
+		w.done <- results[i]
+	}
+}
+
+// applyWrite applies a "set" or "delete" command. The caller must hold
+// f.mu.
+func (f *fsm) applyWrite(c *command, revision uint64) error {
+	switch c.Op {
+	case "set":
+		if _, ok := f.leases[c.Lease]; c.Lease != 0 && !ok {
+			return ErrLeaseNotFound
+		}
+		return f.applySet(c.Key, c.Value, c.Lease, revision)
+	case "delete":
+		return f.applyDelete(c.Key, revision)
+	default:
+		return fmt.Errorf("%w: %q in a batch", ErrUnsupportedCommand, c.Op)
+	}
+}
+
+// applyBatch applies the writes of a batch, in order, at the same revision.
+// A failed write does not affect the others. The response is the result of
+// each write. A batch holding a write this node cannot apply is skipped
+// whole, as any such entry is. The caller must hold f.mu.
+func (f *fsm) applyBatch(l *raft.Log, batch []*command) interface{} {
+	for _, c := range batch {
+		if c.Version > CommandVersion || (c.Op != "set" && c.Op != "delete") {
+			return f.reject(l, c, ErrUnsupportedCommand)
+		}
+	}
+	results := make([]error, len(batch))
+	for i, c := range batch {
+		results[i] = f.applyWrite(c, l.Index)
+	}
+	return results
+}
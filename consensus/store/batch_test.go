@@ -0,0 +1,179 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// openBenchStore opens a single node store with its log on disk, so that
+// every log entry pays for a write to raft.db.
+func openBenchStore(b *testing.B, batchMaxSize int) *Store {
+	s := New(false)
+	s.RaftDir = b.TempDir()
+	s.RaftBind = "127.0.0.1:0"
+	s.BatchMaxSize = batchMaxSize
+	if err := s.Open(true, "node0"); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { s.Close() })
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !s.isLeader() {
+		if time.Now().After(deadline) {
+			b.Fatal("no leader elected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s
+}
+
+// BenchmarkSet measures concurrent writers setting small keys, as nodes
+// reporting heartbeats do, with and without batching. writers is the
+// number of goroutines per CPU.
+func BenchmarkSet(b *testing.B) {
+	for _, writers := range []int{16, 256} {
+		for _, size := range []int{1, 16, 128} {
+			b.Run(fmt.Sprintf("writers=%d/batch=%d", writers, size), func(b *testing.B) {
+				s := openBenchStore(b, size)
+				value := []byte(time.Now().Format(time.RFC3339Nano))
+				var n int64
+
+				b.SetParallelism(writers)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						key := fmt.Sprintf("heartbeat/node-%d", atomic.AddInt64(&n, 1)%1000)
+						if err := s.Set(key, value); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+// writeConcurrently runs the writes at once and returns their results, in
+// order. The store must batch them for longer than they take to queue.
+func writeConcurrently(writes ...func() error) []error {
+	errs := make([]error, len(writes))
+	var wg sync.WaitGroup
+	for i, write := range writes {
+		wg.Add(1)
+		go func(i int, write func() error) {
+			defer wg.Done()
+			errs[i] = write()
+		}(i, write)
+	}
+	wg.Wait()
+	return errs
+}
+
+func openBatchingStore(t *testing.T) *Store {
+	return openTestStore(t, func(s *Store) {
+		s.BatchMaxSize = 100
+		s.BatchDelay = 200 * time.Millisecond
+	})
+}
+
+func TestBatchResults(t *testing.T) {
+	s := openBatchingStore(t)
+	l, err := s.Grant(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("doomed", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	first := s.raft.LastIndex()
+	errs := writeConcurrently(
+		func() error { return s.Set("a", []byte("1")) },
+		func() error { return s.SetWithLease("b", []byte("1"), l.ID) },
+		func() error { return s.SetWithLease("c", []byte("1"), l.ID+1000) },
+		func() error { return s.Delete("doomed") },
+		func() error { return s.Delete("missing") },
+	)
+	if entries := s.raft.LastIndex() - first; entries != 1 {
+		t.Fatalf("5 writes took %d log entries, want 1", entries)
+	}
+	for i, want := range []error{nil, nil, ErrLeaseNotFound, nil, nil} {
+		if !errors.Is(errs[i], want) {
+			t.Errorf("write %d returned %v, want %v", i, errs[i], want)
+		}
+	}
+
+	for key, exists := range map[string]bool{"a": true, "b": true, "c": false, "doomed": false} {
+		kv, err := s.Get(key, ReadOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (kv != nil) != exists {
+			t.Errorf("%s exists is %v, want %v", key, kv != nil, exists)
+		}
+	}
+	a, _ := s.Get("a", ReadOptions{})
+	b, _ := s.Get("b", ReadOptions{})
+	if a.ModRevision != b.ModRevision || b.Lease != l.ID {
+		t.Fatalf("a and b written as %+v and %+v, want the same revision", a, b)
+	}
+}
+
+func TestBatchQuota(t *testing.T) {
+	s := openBatchingStore(t)
+	if err := s.SetNamespace("team", NamespaceLimits{MaxKeys: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each write fits on its own, but only two of them together.
+	var writes []func() error
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("team/%d", i)
+		writes = append(writes, func() error { return s.Set(key, []byte("1")) })
+	}
+	failed := 0
+	for _, err := range writeConcurrently(writes...) {
+		var quota *QuotaError
+		switch {
+		case errors.As(err, &quota):
+			failed++
+		case err != nil:
+			t.Fatal(err)
+		}
+	}
+	if failed != 2 {
+		t.Fatalf("%d writes failed, want 2", failed)
+	}
+	if ns, _ := s.Namespace("team"); ns.Usage.Keys != 2 {
+		t.Fatalf("namespace holds %d keys, want 2", ns.Usage.Keys)
+	}
+}
+
+func TestBatchFallback(t *testing.T) {
+	s := openBatchingStore(t)
+	// A server that publishes no ops predates batches, so the writes are
+	// proposed one by one.
+	if err := s.raft.AddNonvoter("node1", "node1", 0, 0).Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	first := s.raft.LastIndex()
+	errs := writeConcurrently(
+		func() error { return s.Set("a", []byte("1")) },
+		func() error { return s.Set("b", []byte("1")) },
+		func() error { return s.Set("c", []byte("1")) },
+	)
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+	if entries := s.raft.LastIndex() - first; entries != 3 {
+		t.Fatalf("3 writes took %d log entries, want 3", entries)
+	}
+}
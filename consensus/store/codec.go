@@ -0,0 +1,375 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Log entries are encoded in a compact binary format whose first byte is the
+// format version. Entries written before the binary format existed are JSON
+// objects, so they start with '{' and are still decoded.
+//
+// After the version byte, a record is a sequence of fields, each one a tag
+// byte, a uvarint length and the field data. Zero-valued fields are omitted
+// and unknown tags are skipped, so fields can be added without a new version.
+const (
+	codecVersion1 byte = 0x01
+	codecLegacy   byte = '{'
+)
+
+// Field tags of a command record.
+const (
+	tagOp           byte = 1
+	tagKey          byte = 2
+	tagValue        byte = 3
+	tagPrevValue    byte = 4
+	tagPrevRevision byte = 5
+	tagLease        byte = 6
+	tagTTL          byte = 7
+	tagTxn          byte = 8
+	tagVersion      byte = 9
+	tagNodeVersion  byte = 10
+	tagNodeOp       byte = 11 // Repeated, once per op.
+	tagPayload      byte = 12
+	tagBatch        byte = 13 // Repeated, once per batched command.
+)
+
+// Field tags of a transaction record.
+const (
+	tagTxnCompare byte = 1
+	tagTxnSuccess byte = 2
+	tagTxnFailure byte = 3
+)
+
+// Field tags of compare and transaction operation records.
+const (
+	tagCmpKey      byte = 1
+	tagCmpTarget   byte = 2
+	tagCmpResult   byte = 3
+	tagCmpValue    byte = 4
+	tagCmpRevision byte = 5
+	tagCmpExists   byte = 6
+
+	tagOpType  byte = 1
+	tagOpKey   byte = 2
+	tagOpValue byte = 3
+	tagOpLease byte = 4
+)
+
+var errTruncated = errors.New("truncated record")
+
+// encoder appends fields to a record.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) bytes(tag byte, b []byte) {
+	e.buf = append(e.buf, tag)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) string(tag byte, s string) {
+	if s != "" {
+		e.bytes(tag, []byte(s))
+	}
+}
+
+func (e *encoder) uint(tag byte, v uint64) {
+	if v != 0 {
+		e.bytes(tag, binary.AppendUvarint(nil, v))
+	}
+}
+
+func (e *encoder) int(tag byte, v int64) {
+	if v != 0 {
+		e.bytes(tag, binary.AppendVarint(nil, v))
+	}
+}
+
+// decoder iterates over the fields of a record.
+type decoder struct {
+	buf []byte
+}
+
+// next returns the next field. ok is false once the record is exhausted.
+func (d *decoder) next() (tag byte, data []byte, ok bool, err error) {
+	if len(d.buf) == 0 {
+		return 0, nil, false, nil
+	}
+	tag = d.buf[0]
+	n, w := binary.Uvarint(d.buf[1:])
+	if w <= 0 || uint64(len(d.buf)-1-w) < n {
+		return 0, nil, false, errTruncated
+	}
+	data = d.buf[1+w : 1+w+int(n)]
+	d.buf = d.buf[1+w+int(n):]
+	return tag, data, true, nil
+}
+
+func decodeUint(b []byte) (uint64, error) {
+	v, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	return v, nil
+}
+
+func decodeInt(b []byte) (int64, error) {
+	v, n := binary.Varint(b)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	return v, nil
+}
+
+// encodeCommand encodes c in the current log entry format.
+func encodeCommand(c *command) []byte {
+	e := &encoder{buf: []byte{codecVersion1}}
+	e.string(tagOp, c.Op)
+	e.string(tagKey, c.Key)
+	if len(c.Value) > 0 {
+		e.bytes(tagValue, c.Value)
+	}
+	if len(c.PrevValue) > 0 {
+		e.bytes(tagPrevValue, c.PrevValue)
+	}
+	if c.PrevRevision != nil {
+		// Written even when zero, as an expected revision of 0 is meaningful.
+		e.bytes(tagPrevRevision, binary.AppendUvarint(nil, *c.PrevRevision))
+	}
+	e.int(tagLease, c.Lease)
+	e.int(tagTTL, c.TTL)
+	if c.Txn != nil {
+		e.bytes(tagTxn, encodeTxn(c.Txn))
+	}
+	if len(c.Payload) > 0 {
+		e.bytes(tagPayload, c.Payload)
+	}
+	e.uint(tagVersion, c.Version)
+	e.uint(tagNodeVersion, c.NodeVersion)
+	for _, op := range c.NodeOps {
+		e.string(tagNodeOp, op)
+	}
+	for _, b := range c.Batch {
+		e.bytes(tagBatch, encodeCommand(b))
+	}
+	return e.buf
+}
+
+func encodeTxn(t *Txn) []byte {
+	e := &encoder{}
+	for _, c := range t.Compare {
+		ce := &encoder{}
+		ce.string(tagCmpKey, c.Key)
+		ce.string(tagCmpTarget, c.Target)
+		ce.string(tagCmpResult, c.Result)
+		if len(c.Value) > 0 {
+			ce.bytes(tagCmpValue, c.Value)
+		}
+		ce.uint(tagCmpRevision, c.Revision)
+		if c.Exists {
+			ce.bytes(tagCmpExists, []byte{1})
+		}
+		e.bytes(tagTxnCompare, ce.buf)
+	}
+	for _, op := range t.Success {
+		e.bytes(tagTxnSuccess, encodeTxnOp(op))
+	}
+	for _, op := range t.Failure {
+		e.bytes(tagTxnFailure, encodeTxnOp(op))
+	}
+	return e.buf
+}
+
+func encodeTxnOp(op TxnOp) []byte {
+	e := &encoder{}
+	e.string(tagOpType, op.Type)
+	e.string(tagOpKey, op.Key)
+	if len(op.Value) > 0 {
+		e.bytes(tagOpValue, op.Value)
+	}
+	e.int(tagOpLease, op.Lease)
+	return e.buf
+}
+
+// decodeCommand decodes a log entry in any supported format.
+func decodeCommand(b []byte) (*command, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty log entry")
+	}
+	switch b[0] {
+	case codecVersion1:
+		return decodeCommandV1(b[1:])
+	case codecLegacy:
+		return decodeLegacyCommand(b)
+	default:
+		return nil, fmt.Errorf("unknown log entry format %#x", b[0])
+	}
+}
+
+func decodeCommandV1(b []byte) (*command, error) {
+	c := &command{}
+	d := &decoder{buf: b}
+	for {
+		tag, data, ok, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return c, nil
+		}
+		switch tag {
+		case tagOp:
+			c.Op = string(data)
+		case tagKey:
+			c.Key = string(data)
+		case tagValue:
+			c.Value = data
+		case tagPrevValue:
+			c.PrevValue = data
+		case tagPrevRevision:
+			v, err := decodeUint(data)
+			if err != nil {
+				return nil, err
+			}
+			c.PrevRevision = &v
+		case tagLease:
+			if c.Lease, err = decodeInt(data); err != nil {
+				return nil, err
+			}
+		case tagTTL:
+			if c.TTL, err = decodeInt(data); err != nil {
+				return nil, err
+			}
+		case tagTxn:
+			if c.Txn, err = decodeTxn(data); err != nil {
+				return nil, err
+			}
+		case tagVersion:
+			if c.Version, err = decodeUint(data); err != nil {
+				return nil, err
+			}
+		case tagNodeVersion:
+			if c.NodeVersion, err = decodeUint(data); err != nil {
+				return nil, err
+			}
+		case tagNodeOp:
+			c.NodeOps = append(c.NodeOps, string(data))
+		case tagPayload:
+			c.Payload = data
+		case tagBatch:
+			b, err := decodeCommand(data)
+			if err != nil {
+				return nil, err
+			}
+			c.Batch = append(c.Batch, b)
+		}
+	}
+}
+
+func decodeTxn(b []byte) (*Txn, error) {
+	t := &Txn{}
+	d := &decoder{buf: b}
+	for {
+		tag, data, ok, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return t, nil
+		}
+		switch tag {
+		case tagTxnCompare:
+			c, err := decodeCompare(data)
+			if err != nil {
+				return nil, err
+			}
+			t.Compare = append(t.Compare, c)
+		case tagTxnSuccess, tagTxnFailure:
+			op, err := decodeTxnOp(data)
+			if err != nil {
+				return nil, err
+			}
+			if tag == tagTxnSuccess {
+				t.Success = append(t.Success, op)
+			} else {
+				t.Failure = append(t.Failure, op)
+			}
+		}
+	}
+}
+
+func decodeCompare(b []byte) (Compare, error) {
+	c := Compare{}
+	d := &decoder{buf: b}
+	for {
+		tag, data, ok, err := d.next()
+		if err != nil {
+			return c, err
+		}
+		if !ok {
+			return c, nil
+		}
+		switch tag {
+		case tagCmpKey:
+			c.Key = string(data)
+		case tagCmpTarget:
+			c.Target = string(data)
+		case tagCmpResult:
+			c.Result = string(data)
+		case tagCmpValue:
+			c.Value = data
+		case tagCmpRevision:
+			if c.Revision, err = decodeUint(data); err != nil {
+				return c, err
+			}
+		case tagCmpExists:
+			c.Exists = len(data) == 1 && data[0] == 1
+		}
+	}
+}
+
+func decodeTxnOp(b []byte) (TxnOp, error) {
+	op := TxnOp{}
+	d := &decoder{buf: b}
+	for {
+		tag, data, ok, err := d.next()
+		if err != nil {
+			return op, err
+		}
+		if !ok {
+			return op, nil
+		}
+		switch tag {
+		case tagOpType:
+			op.Type = string(data)
+		case tagOpKey:
+			op.Key = string(data)
+		case tagOpValue:
+			op.Value = data
+		case tagOpLease:
+			if op.Lease, err = decodeInt(data); err != nil {
+				return op, err
+			}
+		}
+	}
+}
+
+// legacyCommand is a log entry written as JSON, before the binary format.
+// Only sets and deletes were written that way.
+type legacyCommand struct {
+	Op    string `json:"op,omitempty"`
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+func decodeLegacyCommand(b []byte) (*command, error) {
+	var lc legacyCommand
+	if err := json.Unmarshal(b, &lc); err != nil {
+		return nil, err
+	}
+	return &command{Op: lc.Op, Key: lc.Key, Value: []byte(lc.Value)}, nil
+}
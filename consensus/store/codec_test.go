@@ -0,0 +1,85 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	zero := uint64(0)
+	rev := uint64(7)
+	commands := []*command{
+		{Op: "set", Key: "a", Value: []byte{0, 1, 0xff}, Version: 1},
+		{Op: "set", Key: "leased", Value: []byte("v"), Lease: 3},
+		{Op: "delete", Key: "a"},
+		{Op: "cas", Key: "a", Value: []byte("new"), PrevValue: []byte("old")},
+		// An expected revision of 0 means the key must not exist, so it
+		// must survive the round trip.
+		{Op: "cas", Key: "a", Value: []byte("new"), PrevRevision: &zero},
+		{Op: "cas", Key: "a", Value: []byte("new"), PrevRevision: &rev},
+		{Op: "lease_grant", TTL: 30},
+		{Op: "lease_revoke", Lease: -1},
+		{Op: "node_meta", Key: "node1", Value: []byte("127.0.0.1:11000"), NodeVersion: 2, NodeOps: []string{"set", "txn"}},
+		{Op: "custom", Version: 3, Payload: []byte{9, 9}},
+		{Op: "txn", Txn: &Txn{
+			Compare: []Compare{
+				{Key: "a", Target: "value", Result: "=", Value: []byte("x")},
+				{Key: "b", Target: "mod", Result: ">", Revision: 5},
+				{Key: "c", Target: "exists", Exists: true},
+			},
+			Success: []TxnOp{{Type: "put", Key: "a", Value: []byte("y"), Lease: 4}},
+			Failure: []TxnOp{{Type: "delete", Key: "b"}},
+		}},
+		{Op: "batch", Batch: []*command{
+			{Op: "set", Key: "a", Value: []byte("1")},
+			{Op: "delete", Key: "b"},
+		}},
+	}
+	for _, c := range commands {
+		got, err := decodeCommand(encodeCommand(c))
+		if err != nil {
+			t.Fatalf("%s: %v", c.Op, err)
+		}
+		if !reflect.DeepEqual(got, c) {
+			t.Fatalf("%s decoded as %+v, want %+v", c.Op, got, c)
+		}
+	}
+}
+
+func TestCodecSkipsUnknownFields(t *testing.T) {
+	e := &encoder{buf: encodeCommand(&command{Op: "set", Key: "a", Value: []byte("1")})}
+	e.string(200, "added by a later version")
+	got, err := decodeCommand(e.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&command{Op: "set", Key: "a", Value: []byte("1")}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("decoded as %+v, want %+v", got, want)
+	}
+}
+
+func TestCodecRejectsMalformed(t *testing.T) {
+	valid := encodeCommand(&command{Op: "set", Key: "key", Value: []byte("value")})
+	for name, b := range map[string][]byte{
+		"empty":          nil,
+		"unknown format": {0x7f, 1, 1, 'x'},
+		"truncated":      valid[:len(valid)-2],
+		"bad length":     {codecVersion1, tagOp, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"bad varint":     {codecVersion1, tagLease, 0},
+		"bad batch":      {codecVersion1, tagBatch, 2, 0x7f, 0},
+	} {
+		if _, err := decodeCommand(b); err == nil {
+			t.Errorf("%s: decoded a malformed entry", name)
+		}
+	}
+}
+
+func TestCodecLegacyJSON(t *testing.T) {
+	got, err := decodeCommand([]byte(`{"op":"set","key":"a","value":"1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&command{Op: "set", Key: "a", Value: []byte("1")}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("decoded as %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,159 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+// CommandVersion is the newest command version this node applies. It is
+// raised when the meaning or the payload of an existing op changes, so that
+// nodes running an older binary reject those commands instead of misapplying
+// them.
+const CommandVersion = 1
+
+var (
+	// ErrUnsupportedCommand is returned for a command with an op or a
+	// version that a node does not apply.
+	ErrUnsupportedCommand = errors.New("unsupported command")
+
+	// ErrMalformedCommand is returned for a log entry that cannot be decoded.
+	ErrMalformedCommand = errors.New("malformed command")
+)
+
+// legacyOps are the ops applied by every node, including those that predate
+// the feature gate and publish no ops of their own.
+var legacyOps = []string{
+	"set", "delete", "cas", "create", "update", "txn", "node",
+	"lease_grant", "lease_revoke",
+}
+
+// builtinOps are the ops this binary applies beyond legacyOps. Voters must
+// publish them before the leader proposes them.
+var builtinOps = []string{
+	"ns_set", "ns_delete", "batch",
+}
+
+// CommandError is returned by Apply, as the response of a log entry, when
+// the entry cannot be applied. The entry is skipped and the store is left
+// unchanged, on every node alike.
+type CommandError struct {
+	Index   uint64
+	Op      string
+	Version uint64
+	Err     error
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("cannot apply log entry %d (op %q, version %d): %v", e.Index, e.Op, e.Version, e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// UnsupportedError is returned by the leader when it refuses to propose a
+// command that some voters do not apply yet, typically during a rolling
+// upgrade.
+type UnsupportedError struct {
+	Op      string   `json:"op"`
+	Version uint64   `json:"version"`
+	Nodes   []string `json:"nodes"`
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("op %q version %d is not supported by %s", e.Op, e.Version, strings.Join(e.Nodes, ", "))
+}
+
+// Is makes errors.Is(err, ErrUnsupportedCommand) hold for an
+// *UnsupportedError.
+func (e *UnsupportedError) Is(target error) bool {
+	return target == ErrUnsupportedCommand
+}
+
+// supports reports whether a node publishing meta applies op at version.
+// Nodes that publish no ops predate the feature gate and apply the legacy
+// ops at version 1.
+func (meta NodeMeta) supports(op string, version uint64) bool {
+	if len(meta.Ops) == 0 {
+		return version <= 1 && contains(legacyOps, op)
+	}
+	return version <= meta.CommandVersion && contains(meta.Ops, op)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSupported returns an *UnsupportedError if a server of the
+// configuration, voter or not, does not apply c, so that the leader never
+// proposes an entry some nodes would reject.
+func (s *Store) checkSupported(c *command) error {
+	if c.Version <= 1 && contains(legacyOps, c.Op) {
+		return nil
+	}
+
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return err
+	}
+
+	// This node may not have registered itself yet.
+	local := s.LocalNodeMeta()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var missing []string
+	for _, srv := range future.Configuration().Servers {
+		meta := s.nodes[string(srv.ID)]
+		if string(srv.ID) == s.localID {
+			meta = local
+		}
+		if !meta.supports(c.Op, c.Version) {
+			missing = append(missing, string(srv.ID))
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return &UnsupportedError{Op: c.Op, Version: c.Version, Nodes: missing}
+	}
+	return nil
+}
+
+// reject logs and returns the response of a log entry that cannot be
+// applied. The caller must hold f.mu.
+func (f *fsm) reject(l *raft.Log, c *command, err error) interface{} {
+	funcDesc := "store - Apply"
+
+	cerr := &CommandError{Index: l.Index, Err: err}
+	if c != nil {
+		cerr.Op = c.Op
+		cerr.Version = c.Version
+	}
+	zap.L().Error(
+		funcDesc,
+		zap.String("type", "cannot apply log entry"),
+		zap.String("msg", cerr.Error()),
+	)
+	return cerr
+}
+
+// opsBehind reports whether a node publishing meta lacks some op, or the
+// command version, that the node publishing leader applies.
+func opsBehind(meta, leader NodeMeta) bool {
+	for _, op := range leader.Ops {
+		if !meta.supports(op, leader.CommandVersion) {
+			return true
+		}
+	}
+	return false
+}
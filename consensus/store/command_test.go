@@ -0,0 +1,78 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestApplySkipsUnsupportedEntry(t *testing.T) {
+	s := openTestStore(t)
+	for name, data := range map[string][]byte{
+		"unknown op":        encodeCommand(&command{Op: "future"}),
+		"newer version":     encodeCommand(&command{Op: "set", Key: "a", Version: CommandVersion + 1}),
+		"newer batch write": encodeCommand(&command{Op: "batch", Batch: []*command{{Op: "set", Key: "a"}, {Op: "set", Key: "b", Version: CommandVersion + 1}}}),
+		"malformed":         []byte("{"),
+	} {
+		resp := (*fsm)(s).Apply(&raft.Log{Index: 1000, Data: data})
+		cerr, ok := resp.(*CommandError)
+		if !ok || cerr.Index != 1000 {
+			t.Errorf("%s: response is %v, want a *CommandError of entry 1000", name, resp)
+			continue
+		}
+		want := ErrUnsupportedCommand
+		if name == "malformed" {
+			want = ErrMalformedCommand
+		}
+		if !errors.Is(cerr, want) {
+			t.Errorf("%s: got %v, want %v", name, cerr, want)
+		}
+	}
+	// A batch is applied entirely or not at all.
+	if kv, _ := s.Get("a", ReadOptions{}); kv != nil {
+		t.Fatalf("a written by a skipped batch: %+v", kv)
+	}
+	// The node goes on applying entries.
+	if err := s.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpsBehind(t *testing.T) {
+	leader := NodeMeta{CommandVersion: 1, Ops: []string{"set", "batch"}}
+	for _, tc := range []struct {
+		name   string
+		meta   NodeMeta
+		behind bool
+	}{
+		{"same", leader, false},
+		{"more ops", NodeMeta{CommandVersion: 1, Ops: []string{"set", "batch", "other"}}, false},
+		{"missing op", NodeMeta{CommandVersion: 1, Ops: []string{"set"}}, true},
+		{"older version", NodeMeta{CommandVersion: 0, Ops: []string{"set", "batch"}}, true},
+		{"unpublished", NodeMeta{}, true},
+	} {
+		if got := opsBehind(tc.meta, leader); got != tc.behind {
+			t.Errorf("%s: behind is %v, want %v", tc.name, got, tc.behind)
+		}
+	}
+}
+
+func TestCheckSupportedIncludesNonvoters(t *testing.T) {
+	s := openTestStore(t)
+	// A non-voter that never published its ops applies only the legacy
+	// ones.
+	if err := s.raft.AddNonvoter("node1", "node1", 0, 0).Error(); err != nil {
+		t.Fatal(err)
+	}
+	var unsupported *UnsupportedError
+	if err := s.checkSupported(&command{Op: "ns_set"}); !errors.As(err, &unsupported) {
+		t.Fatalf("got %v, want an *UnsupportedError", err)
+	}
+	if len(unsupported.Nodes) != 1 || unsupported.Nodes[0] != "node1" {
+		t.Fatalf("unsupported by %v, want node1", unsupported.Nodes)
+	}
+	if err := s.checkSupported(&command{Op: "set"}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,340 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+// The leader keeps track of the health of every server. Raft tells it which
+// servers miss their heartbeats, StatusOf how far behind the leader each one
+// is, and LiveMembers which ones the gossip layer still sees. A server that
+// has been gone from gossip for DeadServerGrace, and that Raft cannot reach
+// either, is removed from the Raft configuration, so that it no longer
+// counts against the quorum. Non-voters go first, and a voter only goes if
+// the voters left, MinQuorum at least, still have a healthy majority.
+const defaultDeadServerGrace = 5 * time.Minute
+
+// serverHealth is the health of a server as seen by the leader.
+type serverHealth struct {
+	failing bool
+
+	// since is when the server became healthy, or its last contact with the
+	// leader before it began failing. It is never before the server joined
+	// or the leader took office.
+	since time.Time
+
+	// lastContact is when the server last heard from the leader, if known.
+	lastContact time.Time
+
+	// lag is how many revisions the server was behind the leader when its
+	// status was last fetched, if lagKnown.
+	lag      uint64
+	lagKnown bool
+
+	// deadSince is when the gossip layer stopped seeing the server, zero if
+	// it sees it.
+	deadSince time.Time
+}
+
+// ServerHealth is the health of a server as seen by the leader.
+type ServerHealth struct {
+	ID       string `json:"id"`
+	Suffrage string `json:"suffrage"`
+
+	// Healthy reports whether the leader reaches the server, and Since
+	// when it has, or has not.
+	Healthy bool      `json:"healthy"`
+	Since   time.Time `json:"since"`
+
+	// LastContact is when the server last heard from the leader, if known.
+	LastContact *time.Time `json:"last_contact,omitempty"`
+
+	// Lag is how many revisions the server is behind the leader, if known.
+	Lag *uint64 `json:"lag,omitempty"`
+
+	// DeadSince is when the gossip layer stopped seeing the server, if it
+	// does not.
+	DeadSince *time.Time `json:"dead_since,omitempty"`
+}
+
+// deadServerGrace returns how long a server may be gone from gossip before
+// the leader removes it.
+func (s *Store) deadServerGrace() time.Duration {
+	if s.DeadServerGrace > 0 {
+		return s.DeadServerGrace
+	}
+	return defaultDeadServerGrace
+}
+
+// observe records the heartbeat failures and recoveries reported by Raft
+// until the store is closed. Raft only reports them while this node leads.
+func (s *Store) observe() {
+	for {
+		select {
+		case o := <-s.observations:
+			s.recordHealth(o.Data)
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// isHeartbeatObservation selects the observations observe handles.
+func isHeartbeatObservation(o *raft.Observation) bool {
+	switch o.Data.(type) {
+	case raft.FailedHeartbeatObservation, raft.ResumedHeartbeatObservation:
+		return true
+	}
+	return false
+}
+
+// recordHealth updates the health of a server from a Raft observation.
+func (s *Store) recordHealth(data interface{}) {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+
+	switch o := data.(type) {
+	case raft.FailedHeartbeatObservation:
+		h := s.healthLocked(o.PeerID)
+		if h.failing {
+			return
+		}
+		// A server is not failing since before it joined, or before the
+		// leader took office.
+		h.failing = true
+		if o.LastContact.After(h.since) {
+			h.since = o.LastContact
+		}
+		if !o.LastContact.IsZero() {
+			h.lastContact = o.LastContact
+		}
+		s.health[o.PeerID] = h
+	case raft.ResumedHeartbeatObservation:
+		h := s.healthLocked(o.PeerID)
+		h.failing = false
+		h.since = time.Now()
+		h.lastContact = h.since
+		s.health[o.PeerID] = h
+	}
+}
+
+// resetHealth forgets the health of every server. A new leader considers
+// every server healthy from the moment it takes office.
+func (s *Store) resetHealth() {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	s.leaderSince = time.Now()
+	s.health = make(map[raft.ServerID]serverHealth)
+}
+
+// startHealth considers a server healthy from now on, as it joins.
+func (s *Store) startHealth(id raft.ServerID) {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	s.health[id] = serverHealth{since: time.Now()}
+}
+
+// healthOf returns the health of a server.
+func (s *Store) healthOf(id raft.ServerID) serverHealth {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	return s.healthLocked(id)
+}
+
+// healthLocked returns the health of a server. A server this leader has not
+// seen join is healthy since it took office. The caller must hold
+// s.healthMu.
+func (s *Store) healthLocked(id raft.ServerID) serverHealth {
+	if h, ok := s.health[id]; ok {
+		return h
+	}
+	return serverHealth{since: s.leaderSince}
+}
+
+// healthLoop refreshes the lag and last contact of the servers until stopCh
+// is closed. It runs apart from the leader loop, so that a slow node does
+// not hold up the other duties of the leader.
+func (s *Store) healthLoop(stopCh chan struct{}) {
+	if s.StatusOf == nil {
+		return
+	}
+	ticker := time.NewTicker(leaderTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.refreshHealth()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// refreshHealth fetches the status of every other server, concurrently.
+func (s *Store) refreshHealth() {
+	servers, err := s.Servers()
+	if err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		addr := s.NodeAPIAddr(srv.ID)
+		if srv.ID == s.localID || addr == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(id raft.ServerID, addr string) {
+			defer wg.Done()
+			revision := s.Revision()
+			status, err := s.StatusOf(addr)
+			now := time.Now()
+
+			s.healthMu.Lock()
+			defer s.healthMu.Unlock()
+			h := s.healthLocked(id)
+			h.lagKnown = err == nil
+			if err == nil {
+				h.lag = 0
+				if status.Revision < revision {
+					h.lag = revision - status.Revision
+				}
+				// Followers report how long ago they heard from the leader.
+				if d, err := time.ParseDuration(status.Stats["last_contact"]); err == nil {
+					h.lastContact = now.Add(-d)
+				}
+			}
+			s.health[id] = h
+		}(raft.ServerID(srv.ID), addr)
+	}
+	wg.Wait()
+}
+
+// Health returns the health of every server of the Raft configuration, or
+// nil if this node does not lead.
+func (s *Store) Health() []ServerHealth {
+	if !s.isLeader() {
+		return nil
+	}
+	servers, err := s.Servers()
+	if err != nil {
+		return nil
+	}
+
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	health := make([]ServerHealth, 0, len(servers))
+	for _, srv := range servers {
+		sh := ServerHealth{ID: srv.ID, Suffrage: srv.Suffrage}
+		if srv.ID == s.localID {
+			now := time.Now()
+			var lag uint64
+			sh.Healthy, sh.Since, sh.LastContact, sh.Lag = true, s.leaderSince, &now, &lag
+			health = append(health, sh)
+			continue
+		}
+
+		h := s.healthLocked(raft.ServerID(srv.ID))
+		sh.Healthy, sh.Since = !h.failing, h.since
+		if !h.lastContact.IsZero() {
+			lastContact := h.lastContact
+			sh.LastContact = &lastContact
+		}
+		if h.lagKnown {
+			lag := h.lag
+			sh.Lag = &lag
+		}
+		if !h.deadSince.IsZero() {
+			deadSince := h.deadSince
+			sh.DeadSince = &deadSince
+		}
+		health = append(health, sh)
+	}
+	return health
+}
+
+// pruneDeadServers records which servers the gossip layer no longer sees
+// and removes one that has been gone for DeadServerGrace, if that is safe.
+func (s *Store) pruneDeadServers() {
+	funcDesc := "store - pruneDeadServers"
+
+	live := make(map[raft.ServerID]bool)
+	for _, id := range s.LiveMembers() {
+		live[raft.ServerID(id)] = true
+	}
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		zap.L().Error(
+			funcDesc,
+			zap.String("type", "failed to get raft configuration"),
+			zap.String("msg", err.Error()),
+		)
+		return
+	}
+	local := raft.ServerID(s.localID)
+	grace := s.deadServerGrace()
+	now := time.Now()
+
+	// Dead servers are those gone from gossip for the grace period that Raft
+	// cannot reach either: gossip alone may be partitioned.
+	var dead []raft.Server
+	voters, healthy := 0, 0
+	s.healthMu.Lock()
+	for _, srv := range future.Configuration().Servers {
+		h := s.healthLocked(srv.ID)
+		switch {
+		case live[srv.ID] || srv.ID == local:
+			h.deadSince = time.Time{}
+		case h.deadSince.IsZero():
+			h.deadSince = now
+		}
+		s.health[srv.ID] = h
+
+		if srv.Suffrage == raft.Voter {
+			voters++
+			if !h.failing {
+				healthy++
+			}
+		}
+		if !h.deadSince.IsZero() && h.failing && now.Sub(h.deadSince) >= grace {
+			dead = append(dead, srv)
+		}
+	}
+	s.healthMu.Unlock()
+
+	// Non-voters first: removing them never weakens the quorum.
+	sort.SliceStable(dead, func(i, j int) bool {
+		return dead[i].Suffrage != raft.Voter && dead[j].Suffrage == raft.Voter
+	})
+	for _, srv := range dead {
+		if srv.Suffrage == raft.Voter {
+			left := voters - 1
+			if left < s.MinQuorum || healthy < left/2+1 {
+				zap.L().Debug(
+					funcDesc,
+					zap.String("msg", fmt.Sprintf("keeping dead voter %s: %d healthy of %d voters left", srv.ID, healthy, left)),
+				)
+				continue
+			}
+		}
+
+		zap.L().Warn(
+			funcDesc,
+			zap.String("msg", fmt.Sprintf("removing dead server %s at %s", srv.ID, srv.Address)),
+		)
+		if err := s.raft.RemoveServer(srv.ID, future.Index(), 0).Error(); err != nil {
+			zap.L().Error(
+				funcDesc,
+				zap.String("type", fmt.Sprintf("failed to remove dead server %s", srv.ID)),
+				zap.String("msg", err.Error()),
+			)
+		}
+		return
+	}
+}
@@ -0,0 +1,46 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestPromotable(t *testing.T) {
+	s := New(true)
+	s.StatusOf = func(string) (*Status, error) { return &Status{}, nil }
+	s.resetHealth()
+	s.leaderSince = time.Now().Add(-time.Hour)
+	s.nodes["node1"] = s.LocalNodeMeta()
+
+	const stabilization = time.Second
+	id := raft.ServerID("node1")
+	s.startHealth(id)
+	joined := time.Now()
+	if s.promotable(id, joined.Add(stabilization/2), stabilization) {
+		t.Fatal("promoted a server before it was stable since it joined")
+	}
+	if s.promotable(id, joined.Add(2*stabilization), stabilization) {
+		t.Fatal("promoted a server whose lag is unknown")
+	}
+
+	setLag := func(lag uint64) {
+		h := s.healthOf(id)
+		h.lag, h.lagKnown = lag, true
+		s.health[id] = h
+	}
+	setLag(s.maxPromotionLag() + 1)
+	if s.promotable(id, joined.Add(2*stabilization), stabilization) {
+		t.Fatal("promoted a server too far behind")
+	}
+	setLag(0)
+	if !s.promotable(id, joined.Add(2*stabilization), stabilization) {
+		t.Fatal("did not promote a stable server that caught up")
+	}
+
+	s.nodes["node1"] = NodeMeta{CommandVersion: CommandVersion, Ops: legacyOps}
+	if s.promotable(id, joined.Add(2*stabilization), stabilization) {
+		t.Fatal("promoted a server missing ops of the leader")
+	}
+}
@@ -0,0 +1,124 @@
+package store
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/google/btree"
+)
+
+const (
+	// keyspaceDegree is the degree of the B-tree holding the entries.
+	keyspaceDegree = 32
+
+	// defaultListLimit is the page size of a List without a limit.
+	defaultListLimit = 1000
+
+	// maxListLimit is the largest page size a List can ask for.
+	maxListLimit = 10000
+)
+
+// ErrInvalidContinue is returned when a List is given a continuation token
+// it did not produce.
+var ErrInvalidContinue = errors.New("invalid continuation token")
+
+// keyspace holds the entries of the memory backend ordered by key. Entries
+// are never modified once inserted, which lets snapshots share them with a
+// lazy clone of the tree.
+type keyspace = btree.BTreeG[*KeyValue]
+
+func newKeyspace() *keyspace {
+	return btree.NewG(keyspaceDegree, func(a, b *KeyValue) bool {
+		return a.Key < b.Key
+	})
+}
+
+// ListOptions selects a page of keys in key order. Prefix, Start and End
+// combine, so a prefix can be listed from a given key on.
+type ListOptions struct {
+	// Prefix restricts the listing to the keys starting with it.
+	Prefix string
+
+	// Start is the inclusive lower bound of the listing.
+	Start string
+
+	// End is the exclusive upper bound of the listing. Empty means no bound.
+	End string
+
+	// Limit is the maximum number of keys returned, defaultListLimit if not
+	// set and at most maxListLimit.
+	Limit int
+
+	// Continue is the token returned with the previous page.
+	Continue string
+
+	// Read controls the freshness of the listing.
+	Read ReadOptions
+}
+
+// ListResult is a page of entries.
+type ListResult struct {
+	Items []*KeyValue `json:"items"`
+
+	// Continue is set when more keys match, and resumes the listing after
+	// the last item of this page.
+	Continue string `json:"continue,omitempty"`
+
+	// Revision is the revision of the store the page was read at.
+	Revision uint64 `json:"revision"`
+}
+
+// List returns a page of the entries selected by opts, in key order.
+func (s *Store) List(opts ListOptions) (*ListResult, error) {
+	if err := s.checkRead(opts.Read); err != nil {
+		return nil, err
+	}
+
+	lower := opts.Start
+	if opts.Prefix > lower {
+		lower = opts.Prefix
+	}
+	if opts.Continue != "" {
+		last, err := base64.RawURLEncoding.DecodeString(opts.Continue)
+		if err != nil {
+			return nil, ErrInvalidContinue
+		}
+		// The smallest key greater than the last key of the previous page.
+		if after := string(last) + "\x00"; after > lower {
+			lower = after
+		}
+	}
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := &ListResult{Items: []*KeyValue{}, Revision: s.revision}
+	err := s.m.Ascend(lower, func(kv *KeyValue) bool {
+		if opts.End != "" && kv.Key >= opts.End {
+			return false
+		}
+		if !strings.HasPrefix(kv.Key, opts.Prefix) {
+			return false
+		}
+		if len(res.Items) == limit {
+			last := res.Items[len(res.Items)-1].Key
+			res.Continue = base64.RawURLEncoding.EncodeToString([]byte(last))
+			return false
+		}
+		res.Items = append(res.Items, kv)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
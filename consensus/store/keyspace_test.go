@@ -0,0 +1,87 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+// itemKeys returns the keys of a page.
+func itemKeys(res *ListResult) []string {
+	keys := []string{}
+	for _, kv := range res.Items {
+		keys = append(keys, kv.Key)
+	}
+	return keys
+}
+
+func TestList(t *testing.T) {
+	for _, kind := range []string{BackendMemory, BackendBolt} {
+		t.Run(kind, func(t *testing.T) {
+			s := openTestStore(t, func(s *Store) {
+				s.Backend = kind
+				s.RaftDir = t.TempDir()
+			})
+			all := []string{"a", "b/1", "b/2", "b/3", "c"}
+			for _, key := range all {
+				if err := s.Set(key, []byte(key)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, tc := range []struct {
+				name string
+				opts ListOptions
+				keys []string
+				more bool
+			}{
+				{"all", ListOptions{}, all, false},
+				{"prefix", ListOptions{Prefix: "b/"}, []string{"b/1", "b/2", "b/3"}, false},
+				{"prefix from start", ListOptions{Prefix: "b/", Start: "b/2"}, []string{"b/2", "b/3"}, false},
+				{"start before prefix", ListOptions{Prefix: "b/", Start: "a"}, []string{"b/1", "b/2", "b/3"}, false},
+				{"bounds", ListOptions{Start: "b", End: "b/3"}, []string{"b/1", "b/2"}, false},
+				{"limit", ListOptions{Limit: 2}, []string{"a", "b/1"}, true},
+				{"limit of every key", ListOptions{Limit: len(all)}, all, false},
+				{"no match", ListOptions{Prefix: "z"}, []string{}, false},
+			} {
+				res, err := s.List(tc.opts)
+				if err != nil {
+					t.Fatalf("%s: %v", tc.name, err)
+				}
+				if got := itemKeys(res); !reflect.DeepEqual(got, tc.keys) {
+					t.Errorf("%s: got %q, want %q", tc.name, got, tc.keys)
+				}
+				if more := res.Continue != ""; more != tc.more {
+					t.Errorf("%s: more pages is %v, want %v", tc.name, more, tc.more)
+				}
+			}
+
+			// Following the continuation tokens lists every key once.
+			var keys []string
+			opts := ListOptions{Prefix: "b/", Limit: 2}
+			for pages := 0; ; pages++ {
+				if pages > len(all) {
+					t.Fatal("continuation tokens do not end")
+				}
+				res, err := s.List(opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.Revision != s.Revision() {
+					t.Fatalf("page read at revision %d, want %d", res.Revision, s.Revision())
+				}
+				keys = append(keys, itemKeys(res)...)
+				if res.Continue == "" {
+					break
+				}
+				opts.Continue = res.Continue
+			}
+			if want := []string{"b/1", "b/2", "b/3"}; !reflect.DeepEqual(keys, want) {
+				t.Fatalf("pages hold %q, want %q", keys, want)
+			}
+
+			if _, err := s.List(ListOptions{Continue: "not a token!"}); err != ErrInvalidContinue {
+				t.Fatalf("got %v, want ErrInvalidContinue", err)
+			}
+		})
+	}
+}
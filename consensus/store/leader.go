@@ -0,0 +1,65 @@
+package store
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// leaderTickInterval is how often the leader runs its periodic duties.
+const leaderTickInterval = 500 * time.Millisecond
+
+// monitorLeadership starts the leader duties whenever this node acquires
+// leadership and stops them when it loses it.
+func (s *Store) monitorLeadership() {
+	funcDesc := "store - monitorLeadership"
+
+	var stopCh chan struct{}
+	for {
+		select {
+		case isLeader := <-s.leaderCh:
+			switch {
+			case isLeader && stopCh == nil:
+				zap.L().Info(funcDesc, zap.String("msg", "acquired leadership"))
+				stopCh = make(chan struct{})
+				go s.leaderLoop(stopCh)
+			case !isLeader && stopCh != nil:
+				zap.L().Info(funcDesc, zap.String("msg", "lost leadership"))
+				close(stopCh)
+				stopCh = nil
+			}
+
+		case <-s.shutdownCh:
+			if stopCh != nil {
+				close(stopCh)
+			}
+			return
+		}
+	}
+}
+
+// leaderLoop runs the duties of the leader until stopCh is closed.
+func (s *Store) leaderLoop(stopCh chan struct{}) {
+	s.resetLeaseExpiry()
+	s.resetHealth()
+	go s.healthLoop(stopCh)
+
+	ticker := time.NewTicker(leaderTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.registerSelf()
+			s.expireLeases()
+			if s.LiveMembers != nil {
+				s.pruneDeadServers()
+			}
+			if s.VoterTarget > 0 {
+				s.reconcileVoters()
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// minLeaseTTL is the shortest TTL a lease can be granted with. Shorter leases
+// could expire during a leader election.
+const minLeaseTTL = 2 * time.Second
+
+var (
+	// ErrLeaseNotFound is returned when a lease does not exist, either
+	// because it was never granted or because it expired or was revoked.
+	ErrLeaseNotFound = errors.New("lease not found")
+
+	// ErrInvalidTTL is returned when a lease is requested with a TTL below
+	// minLeaseTTL.
+	ErrInvalidTTL = fmt.Errorf("lease TTL must be at least %s", minLeaseTTL)
+)
+
+// Lease is a time-to-live that keys can be attached to. When the lease
+// expires or is revoked, every key attached to it is deleted.
+type Lease struct {
+	// ID is the index of the log entry that granted the lease.
+	ID int64 `json:"id"`
+
+	// TTL is the lifetime of the lease in seconds, renewed by keep-alives.
+	TTL int64 `json:"ttl"`
+}
+
+// LeaseStatus reports a lease together with its attached keys.
+type LeaseStatus struct {
+	Lease
+
+	// Remaining is the number of seconds left before the lease expires. It
+	// is only tracked by the leader and is zero elsewhere.
+	Remaining int64 `json:"remaining"`
+
+	Keys []string `json:"keys"`
+}
+
+// lease is the FSM state of a lease. The expiry is volatile: it is only
+// acted upon by the leader, which resets it on every leadership change.
+type lease struct {
+	Lease
+	keys   map[string]struct{}
+	expiry time.Time
+}
+
+func newLease(id, ttl int64) *lease {
+	l := &lease{
+		Lease: Lease{ID: id, TTL: ttl},
+		keys:  make(map[string]struct{}),
+	}
+	l.refresh()
+	return l
+}
+
+func (l *lease) refresh() {
+	l.expiry = time.Now().Add(time.Duration(l.TTL) * time.Second)
+}
+
+// Grant creates a lease with the given TTL, rounded up to whole seconds.
+func (s *Store) Grant(ttl time.Duration) (*Lease, error) {
+	if ttl < minLeaseTTL {
+		return nil, ErrInvalidTTL
+	}
+	secs := int64((ttl + time.Second - 1) / time.Second)
+
+	resp, err := s.apply(&command{
+		Op:  "lease_grant",
+		TTL: secs,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Lease{ID: resp.(int64), TTL: secs}, nil
+}
+
+// Revoke deletes the lease and every key attached to it.
+func (s *Store) Revoke(id int64) error {
+	_, err := s.apply(&command{
+		Op:    "lease_revoke",
+		Lease: id,
+	})
+	return err
+}
+
+// KeepAlive renews the lease for another TTL. Expiry is tracked by the
+// leader only, so keep-alives are not replicated and must be sent to it.
+func (s *Store) KeepAlive(id int64) (*Lease, error) {
+	if !s.isLeader() {
+		return nil, s.notLeader()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.leases[id]
+	if !ok {
+		return nil, ErrLeaseNotFound
+	}
+	l.refresh()
+	return &l.Lease, nil
+}
+
+// TimeToLive returns the status of the lease.
+func (s *Store) TimeToLive(id int64) (*LeaseStatus, error) {
+	leader := s.isLeader()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.leases[id]
+	if !ok {
+		return nil, ErrLeaseNotFound
+	}
+
+	status := &LeaseStatus{Lease: l.Lease, Keys: make([]string, 0, len(l.keys))}
+	if leader {
+		if remaining := time.Until(l.expiry); remaining > 0 {
+			status.Remaining = int64(remaining.Round(time.Second) / time.Second)
+		}
+	}
+	for k := range l.keys {
+		status.Keys = append(status.Keys, k)
+	}
+	sort.Strings(status.Keys)
+	return status, nil
+}
+
+// SetWithLease sets the value for the given key and attaches the key to the
+// lease, so that it is deleted when the lease goes away.
+func (s *Store) SetWithLease(key string, value []byte, id int64) error {
+	return s.write(&command{
+		Op:    "set",
+		Key:   key,
+		Value: value,
+		Lease: id,
+	})
+}
+
+// resetLeaseExpiry gives every lease a full TTL. It is called when this node
+// becomes leader, as expiry deadlines are not replicated.
+func (s *Store) resetLeaseExpiry() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range s.leases {
+		l.refresh()
+	}
+}
+
+// expireLeases revokes, through Raft, every lease whose TTL has elapsed.
+func (s *Store) expireLeases() {
+	funcDesc := "store - expireLeases"
+
+	now := time.Now()
+	var expired []int64
+	s.mu.Lock()
+	for id, l := range s.leases {
+		if now.After(l.expiry) {
+			expired = append(expired, id)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, id := range expired {
+		if err := s.Revoke(id); err != nil && err != ErrLeaseNotFound {
+			zap.L().Error(
+				funcDesc,
+				zap.String("type", "failed to revoke expired lease"),
+				zap.Int64("lease", id),
+				zap.String("msg", err.Error()),
+			)
+			continue
+		}
+		zap.L().Info(
+			funcDesc,
+			zap.String("msg", fmt.Sprintf("lease %d expired", id)),
+		)
+	}
+}
+
+// applyLeaseGrant creates a lease identified by the log index. The caller
+// must hold f.mu.
+func (f *fsm) applyLeaseGrant(ttl int64, index uint64) interface{} {
+	id := int64(index)
+	f.leases[id] = newLease(id, ttl)
+	return id
+}
+
+// applyLeaseRevoke deletes a lease and its keys at the given revision. The
+// caller must hold f.mu.
+func (f *fsm) applyLeaseRevoke(id int64, revision uint64) interface{} {
+	l, ok := f.leases[id]
+	if !ok {
+		return ErrLeaseNotFound
+	}
+	keys := make([]string, 0, len(l.keys))
+	for k := range l.keys {
+		keys = append(keys, k)
+	}
+	// Sort so that every node emits the delete events in the same order.
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := f.applyDelete(k, revision); err != nil {
+			return err
+		}
+	}
+	delete(f.leases, id)
+	return nil
+}
+
+// attach moves key to the lease with the given id, detaching it from any
+// previous lease. An id of 0 only detaches. The caller must hold f.mu.
+func (f *fsm) attach(key string, prev, id int64) {
+	if prev == id {
+		return
+	}
+	if l, ok := f.leases[prev]; ok {
+		delete(l.keys, key)
+	}
+	if l, ok := f.leases[id]; ok {
+		l.keys[key] = struct{}{}
+	}
+}
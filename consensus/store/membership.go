@@ -0,0 +1,277 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrServerNotFound is returned when a server is not in the Raft
+	// configuration.
+	ErrServerNotFound = errors.New("server not found")
+
+	// ErrNotVoter is returned when leadership is transferred to a non-voter.
+	ErrNotVoter = errors.New("server is not a voter")
+
+	// ErrLastVoter is returned when removing or demoting the only voter,
+	// which would leave the cluster unable to elect a leader.
+	ErrLastVoter = errors.New("server is the last voter")
+
+	// ErrNoTransferTarget is returned when leadership is transferred in a
+	// cluster with no other voter.
+	ErrNoTransferTarget = errors.New("no other voter to transfer leadership to")
+)
+
+// With a VoterTarget, nodes join as non-voters: they receive the log but do
+// not count toward the quorum, so a node that is still catching up, or that
+// leaves soon after joining, does not make writes slower or the cluster less
+// available. The leader promotes a non-voter once it has been healthy for
+// ServerStabilization, is within MaxPromotionLag revisions of the leader and
+// publishes every op the leader applies. Non-voters are promoted one at a
+// time, until the cluster has VoterTarget voters. A voter the leader has not
+// reached for ServerStabilization is demoted, so that it no longer counts
+// toward the quorum, and a healthy non-voter can take its place.
+const (
+	defaultServerStabilization = 10 * time.Second
+	defaultMaxPromotionLag     = 1024
+)
+
+// serverStabilization returns how long a server must stay healthy, or
+// failing, before the leader acts on it.
+func (s *Store) serverStabilization() time.Duration {
+	if s.ServerStabilization > 0 {
+		return s.ServerStabilization
+	}
+	return defaultServerStabilization
+}
+
+// maxPromotionLag returns how many revisions a non-voter may be behind the
+// leader and still be promoted.
+func (s *Store) maxPromotionLag() uint64 {
+	if s.MaxPromotionLag > 0 {
+		return s.MaxPromotionLag
+	}
+	return defaultMaxPromotionLag
+}
+
+// reconcileVoters demotes a failed voter or, if there are fewer voters than
+// VoterTarget, promotes a non-voter. It changes at most one server per call,
+// so that every change is committed before the next one is decided.
+func (s *Store) reconcileVoters() {
+	funcDesc := "store - reconcileVoters"
+
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		zap.L().Error(
+			funcDesc,
+			zap.String("type", "failed to get raft configuration"),
+			zap.String("msg", err.Error()),
+		)
+		return
+	}
+	servers := future.Configuration().Servers
+	stabilization := s.serverStabilization()
+	now := time.Now()
+
+	// A failed voter counts toward the quorum without helping to reach it.
+	voters := 0
+	for _, srv := range servers {
+		if srv.Suffrage != raft.Voter {
+			continue
+		}
+		voters++
+		if srv.ID == raft.ServerID(s.localID) {
+			continue
+		}
+		h := s.healthOf(srv.ID)
+		if !h.failing || now.Sub(h.since) < stabilization {
+			continue
+		}
+		zap.L().Warn(
+			funcDesc,
+			zap.String("msg", fmt.Sprintf("demoting voter %s, unreachable since %s", srv.ID, h.since.Format(time.RFC3339))),
+		)
+		if err := s.raft.DemoteVoter(srv.ID, future.Index(), 0).Error(); err != nil {
+			zap.L().Error(
+				funcDesc,
+				zap.String("type", fmt.Sprintf("failed to demote voter %s", srv.ID)),
+				zap.String("msg", err.Error()),
+			)
+		}
+		return
+	}
+
+	if voters >= s.VoterTarget {
+		return
+	}
+	for _, srv := range servers {
+		if srv.Suffrage != raft.Nonvoter || !s.promotable(srv.ID, now, stabilization) {
+			continue
+		}
+		zap.L().Info(
+			funcDesc,
+			zap.String("msg", fmt.Sprintf("promoting non-voter %s, %d of %d voters", srv.ID, voters+1, s.VoterTarget)),
+		)
+		if err := s.raft.AddVoter(srv.ID, srv.Address, future.Index(), 0).Error(); err != nil {
+			zap.L().Error(
+				funcDesc,
+				zap.String("type", fmt.Sprintf("failed to promote non-voter %s", srv.ID)),
+				zap.String("msg", err.Error()),
+			)
+		}
+		return
+	}
+}
+
+// promotable reports whether a non-voter is healthy and caught up enough to
+// become a voter. Without StatusOf, or an API address for the node, its lag
+// is never known and it is not promoted. A node running an older binary
+// than the leader is not promoted until it is upgraded.
+func (s *Store) promotable(id raft.ServerID, now time.Time, stabilization time.Duration) bool {
+	h := s.healthOf(id)
+	if h.failing || now.Sub(h.since) < stabilization {
+		return false
+	}
+
+	s.mu.Lock()
+	meta := s.nodes[string(id)]
+	s.mu.Unlock()
+	if opsBehind(meta, s.LocalNodeMeta()) {
+		return false
+	}
+
+	return h.lagKnown && h.lag <= s.maxPromotionLag()
+}
+
+// Server is a member of the Raft configuration.
+type Server struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Suffrage string `json:"suffrage"` // "Voter" or "Nonvoter".
+}
+
+// Servers returns the members of the latest Raft configuration known to this
+// node.
+func (s *Store) Servers() ([]Server, error) {
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	var servers []Server
+	for _, srv := range future.Configuration().Servers {
+		servers = append(servers, Server{
+			ID:       string(srv.ID),
+			Address:  string(srv.Address),
+			Suffrage: srv.Suffrage.String(),
+		})
+	}
+	return servers, nil
+}
+
+// server returns a server of the latest Raft configuration, and the number
+// of voters in it.
+func (s *Store) server(id string) (*raft.Server, int, error) {
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, 0, err
+	}
+	var found *raft.Server
+	voters := 0
+	for _, srv := range future.Configuration().Servers {
+		if srv.Suffrage == raft.Voter {
+			voters++
+		}
+		if srv.ID == raft.ServerID(id) {
+			srv := srv
+			found = &srv
+		}
+	}
+	if found == nil {
+		return nil, voters, ErrServerNotFound
+	}
+	return found, voters, nil
+}
+
+// RemoveServer removes a server from the Raft configuration. A leader that
+// removes itself steps down once the change is committed.
+func (s *Store) RemoveServer(id string) error {
+	funcDesc := "store - RemoveServer"
+
+	if !s.isLeader() {
+		return s.notLeader()
+	}
+	srv, voters, err := s.server(id)
+	if err != nil {
+		return err
+	}
+	if srv.Suffrage == raft.Voter && voters == 1 {
+		return ErrLastVoter
+	}
+
+	zap.L().Info(funcDesc, zap.String("msg", fmt.Sprintf("removing server %s at %s", id, srv.Address)))
+	return s.raft.RemoveServer(srv.ID, 0, 0).Error()
+}
+
+// DemoteVoter makes a voter a non-voter. It keeps receiving the log but no
+// longer counts toward the quorum. With a VoterTarget, the leader may
+// promote it again to reach the target.
+func (s *Store) DemoteVoter(id string) error {
+	funcDesc := "store - DemoteVoter"
+
+	if !s.isLeader() {
+		return s.notLeader()
+	}
+	srv, voters, err := s.server(id)
+	if err != nil {
+		return err
+	}
+	if srv.Suffrage != raft.Voter {
+		return nil
+	}
+	if voters == 1 {
+		return ErrLastVoter
+	}
+
+	zap.L().Info(funcDesc, zap.String("msg", fmt.Sprintf("demoting voter %s", id)))
+	return s.raft.DemoteVoter(srv.ID, 0, 0).Error()
+}
+
+// TransferLeadership hands leadership over to the voter id, or if id is
+// empty, to the voter with the most of the log. It returns once the target
+// has been asked to start an election, usually before it has won it.
+func (s *Store) TransferLeadership(id string) error {
+	funcDesc := "store - TransferLeadership"
+
+	if !s.isLeader() {
+		return s.notLeader()
+	}
+	if id == s.localID {
+		return nil
+	}
+
+	if id == "" {
+		_, voters, err := s.server(s.localID)
+		if err != nil {
+			return err
+		}
+		if voters < 2 {
+			return ErrNoTransferTarget
+		}
+		zap.L().Info(funcDesc, zap.String("msg", "transferring leadership to the most up-to-date voter"))
+		return s.raft.LeadershipTransfer().Error()
+	}
+
+	srv, _, err := s.server(id)
+	if err != nil {
+		return err
+	}
+	if srv.Suffrage != raft.Voter {
+		return ErrNotVoter
+	}
+	zap.L().Info(funcDesc, zap.String("msg", fmt.Sprintf("transferring leadership to %s", id)))
+	return s.raft.LeadershipTransferToServer(srv.ID, srv.Address).Error()
+}
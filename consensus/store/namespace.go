@@ -0,0 +1,440 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// NamespaceSeparator separates the namespace of a key from the rest of it.
+// The keys of namespace "billing" are the keys starting with "billing/".
+const NamespaceSeparator = "/"
+
+var (
+	// ErrNamespaceNotFound is returned for a namespace that does not exist.
+	ErrNamespaceNotFound = errors.New("namespace not found")
+
+	// ErrInvalidNamespace is returned for a malformed namespace name or
+	// negative limits.
+	ErrInvalidNamespace = errors.New("invalid namespace")
+
+	// ErrQuotaExceeded is returned when a write would take a namespace past
+	// one of its limits.
+	ErrQuotaExceeded = errors.New("namespace quota exceeded")
+)
+
+var namespaceName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Limits of a namespace.
+const (
+	LimitKeys      = "keys"
+	LimitBytes     = "bytes"
+	LimitValueSize = "value_size"
+)
+
+// NamespaceLimits are the quotas of a namespace. Zero means no limit.
+type NamespaceLimits struct {
+	// MaxKeys is the largest number of keys in the namespace.
+	MaxKeys int64 `json:"max_keys,omitempty"`
+
+	// MaxBytes is the largest total size of the keys and values of the
+	// namespace.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+
+	// MaxValueSize is the largest size of a single value.
+	MaxValueSize int64 `json:"max_value_size,omitempty"`
+}
+
+// NamespaceUsage is what a namespace currently holds.
+type NamespaceUsage struct {
+	Keys  int64 `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+// NamespaceStatus describes a namespace.
+type NamespaceStatus struct {
+	Name   string          `json:"name"`
+	Limits NamespaceLimits `json:"limits"`
+	Usage  NamespaceUsage  `json:"usage"`
+}
+
+// QuotaError is returned when a write would take a namespace past one of
+// its limits.
+type QuotaError struct {
+	Namespace string `json:"namespace"`
+	Limit     string `json:"limit"`
+	Max       int64  `json:"max"`
+	Requested int64  `json:"requested"`
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s: namespace %q allows %d %s, write needs %d", ErrQuotaExceeded, e.Namespace, e.Max, e.Limit, e.Requested)
+}
+
+// Is makes errors.Is(err, ErrQuotaExceeded) hold for a *QuotaError.
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// namespace is the replicated state of a namespace. Its usage is derived
+// from the entries, so it is not saved in snapshots.
+type namespace struct {
+	limits NamespaceLimits
+	usage  NamespaceUsage
+}
+
+// NamespaceKey returns the key of the store for key in namespace ns.
+func NamespaceKey(ns, key string) string {
+	if ns == "" {
+		return key
+	}
+	return ns + NamespaceSeparator + key
+}
+
+// namespaceOf returns the namespace name a key of the store would belong to.
+func namespaceOf(key string) string {
+	if i := strings.Index(key, NamespaceSeparator); i > 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+// entrySize is what an entry counts towards the bytes of its namespace.
+func entrySize(kv *KeyValue) int64 {
+	return int64(len(kv.Key) + len(kv.Value))
+}
+
+// ValidNamespace reports whether name can name a namespace: a non-empty
+// run of letters, digits, '_', '.' and '-'.
+func ValidNamespace(name string) bool {
+	return namespaceName.MatchString(name)
+}
+
+func validateNamespace(name string, limits NamespaceLimits) error {
+	if !ValidNamespace(name) {
+		return fmt.Errorf("%w: name %q", ErrInvalidNamespace, name)
+	}
+	if limits.MaxKeys < 0 || limits.MaxBytes < 0 || limits.MaxValueSize < 0 {
+		return fmt.Errorf("%w: negative limit", ErrInvalidNamespace)
+	}
+	return nil
+}
+
+// SetNamespace creates the namespace name, or changes its limits. The keys
+// it already holds are kept and counted, even if they exceed the limits.
+func (s *Store) SetNamespace(name string, limits NamespaceLimits) error {
+	if err := validateNamespace(name, limits); err != nil {
+		return err
+	}
+	_, err := s.apply(&command{
+		Op:      "ns_set",
+		Key:     name,
+		Payload: encodeNamespaceLimits(limits),
+	})
+	return err
+}
+
+// DeleteNamespace removes the limits of a namespace. Its keys are kept.
+func (s *Store) DeleteNamespace(name string) error {
+	_, err := s.apply(&command{
+		Op:  "ns_delete",
+		Key: name,
+	})
+	return err
+}
+
+// Namespace returns the limits and usage of a namespace.
+func (s *Store) Namespace(name string) (*NamespaceStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ns, ok := s.namespaces[name]
+	if !ok {
+		return nil, ErrNamespaceNotFound
+	}
+	return &NamespaceStatus{Name: name, Limits: ns.limits, Usage: ns.usage}, nil
+}
+
+// Namespaces returns the limits and usage of every namespace, by name.
+func (s *Store) Namespaces() []*NamespaceStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*NamespaceStatus, 0, len(s.namespaces))
+	for name, ns := range s.namespaces {
+		list = append(list, &NamespaceStatus{Name: name, Limits: ns.limits, Usage: ns.usage})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// checkQuota returns a *QuotaError if applying c would take a namespace
+// past one of its limits. It runs on the leader before c is proposed, so
+// concurrent writes can overshoot a limit by what is in flight.
+func (s *Store) checkQuota(c *command) error {
+	var puts []TxnOp
+	switch c.Op {
+	case "set", "cas", "create", "update":
+		puts = []TxnOp{{Type: TxnPut, Key: c.Key, Value: c.Value}}
+	case "txn":
+		// Either branch may run, so both must fit.
+		if err := s.checkQuotaOps(c.Txn.Success); err != nil {
+			return err
+		}
+		puts = c.Txn.Failure
+	case "batch":
+		for _, err := range s.checkBatchQuota(c.Batch) {
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return s.checkQuotaOps(puts)
+}
+
+// checkQuotaOps checks the ops of a transaction, which apply together: the
+// namespaces must fit what they hold once every op is applied.
+func (s *Store) checkQuotaOps(ops []TxnOp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.namespaces) == 0 {
+		return nil
+	}
+
+	q := s.newQuotaTracker()
+	for _, op := range ops {
+		w, ok, err := q.effect(op)
+		if err != nil {
+			return err
+		}
+		if ok {
+			q.add(w)
+		}
+	}
+	for name, usage := range q.usage {
+		ns := s.namespaces[name]
+		if err := ns.exceeds(name, ns.usage, usage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkBatchQuota checks the writes of a batch, which apply one by one: a
+// write must fit what its namespace holds after the writes before it that
+// fit. It returns the error of each write, nil for those that fit.
+func (s *Store) checkBatchQuota(batch []*command) []error {
+	errs := make([]error, len(batch))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.namespaces) == 0 {
+		return errs
+	}
+
+	q := s.newQuotaTracker()
+	for i, c := range batch {
+		op := TxnOp{Type: TxnPut, Key: c.Key, Value: c.Value}
+		if c.Op == "delete" {
+			op.Type = TxnDelete
+		}
+		w, ok, err := q.effect(op)
+		if err == nil && ok {
+			if err = s.namespaces[w.name].exceeds(w.name, w.before, w.after); err == nil {
+				q.add(w)
+			}
+		}
+		errs[i] = err
+	}
+	return errs
+}
+
+// quotaTracker adds up the effect on the usage of the namespaces of writes
+// not proposed yet. The caller must hold s.mu.
+type quotaTracker struct {
+	s     *Store
+	sizes map[string]int64          // Size of the keys written, 0 if deleted.
+	usage map[string]NamespaceUsage // Usage of the namespaces written to.
+}
+
+// quotaWrite is the effect of a write on the usage of its namespace.
+type quotaWrite struct {
+	key, name     string
+	size          int64 // Size of the entry written, 0 for a delete.
+	before, after NamespaceUsage
+}
+
+func (s *Store) newQuotaTracker() *quotaTracker {
+	return &quotaTracker{
+		s:     s,
+		sizes: make(map[string]int64),
+		usage: make(map[string]NamespaceUsage),
+	}
+}
+
+// effect returns the effect of op after the writes added so far, and false
+// if its key is in no namespace. It returns a *QuotaError if op puts a value
+// over the size limit.
+func (q *quotaTracker) effect(op TxnOp) (quotaWrite, bool, error) {
+	w := quotaWrite{key: op.Key, name: namespaceOf(op.Key)}
+	ns, ok := q.s.namespaces[w.name]
+	if !ok {
+		return w, false, nil
+	}
+	if op.Type == TxnPut && ns.limits.MaxValueSize > 0 && int64(len(op.Value)) > ns.limits.MaxValueSize {
+		return w, false, &QuotaError{Namespace: w.name, Limit: LimitValueSize, Max: ns.limits.MaxValueSize, Requested: int64(len(op.Value))}
+	}
+
+	prev, ok := q.sizes[op.Key]
+	if !ok {
+		kv, err := q.s.m.Get(op.Key)
+		if err != nil {
+			return w, false, err
+		}
+		if kv != nil {
+			prev = entrySize(kv)
+		}
+	}
+	if w.before, ok = q.usage[w.name]; !ok {
+		w.before = ns.usage
+	}
+
+	w.after = w.before
+	if prev > 0 {
+		w.after.Keys--
+		w.after.Bytes -= prev
+	}
+	if op.Type == TxnPut {
+		w.size = entrySize(&KeyValue{Key: op.Key, Value: op.Value})
+		w.after.Keys++
+		w.after.Bytes += w.size
+	}
+	return w, true, nil
+}
+
+// add records a write returned by effect.
+func (q *quotaTracker) add(w quotaWrite) {
+	q.sizes[w.key] = w.size
+	q.usage[w.name] = w.after
+}
+
+// exceeds returns a *QuotaError if going from usage before to after takes
+// the namespace name past one of its limits. Writes that do not grow a
+// namespace are always allowed, so that a namespace over its limits can be
+// cleaned up.
+func (ns *namespace) exceeds(name string, before, after NamespaceUsage) error {
+	if after.Keys > before.Keys && ns.limits.MaxKeys > 0 && after.Keys > ns.limits.MaxKeys {
+		return &QuotaError{Namespace: name, Limit: LimitKeys, Max: ns.limits.MaxKeys, Requested: after.Keys}
+	}
+	if after.Bytes > before.Bytes && ns.limits.MaxBytes > 0 && after.Bytes > ns.limits.MaxBytes {
+		return &QuotaError{Namespace: name, Limit: LimitBytes, Max: ns.limits.MaxBytes, Requested: after.Bytes}
+	}
+	return nil
+}
+
+// applyNamespaceSet creates a namespace or changes its limits. A new
+// namespace counts the keys it already holds. The caller must hold f.mu.
+func (f *fsm) applyNamespaceSet(name string, payload []byte) interface{} {
+	limits, err := decodeNamespaceLimits(payload)
+	if err != nil {
+		return err
+	}
+	if ns, ok := f.namespaces[name]; ok {
+		ns.limits = limits
+		return nil
+	}
+
+	ns := &namespace{limits: limits}
+	prefix := name + NamespaceSeparator
+	err = f.tx.Ascend(prefix, func(kv *KeyValue) bool {
+		if !strings.HasPrefix(kv.Key, prefix) {
+			return false
+		}
+		ns.usage.Keys++
+		ns.usage.Bytes += entrySize(kv)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	f.namespaces[name] = ns
+	return nil
+}
+
+// applyNamespaceDelete removes a namespace. The caller must hold f.mu.
+func (f *fsm) applyNamespaceDelete(name string) interface{} {
+	if _, ok := f.namespaces[name]; !ok {
+		return ErrNamespaceNotFound
+	}
+	delete(f.namespaces, name)
+	return nil
+}
+
+// account updates the usage of the namespace of a key replaced from prev to
+// next, either of which may be nil. The caller must hold f.mu.
+func account(namespaces map[string]*namespace, prev, next *KeyValue) {
+	kv := next
+	if kv == nil {
+		kv = prev
+	}
+	ns, ok := namespaces[namespaceOf(kv.Key)]
+	if !ok {
+		return
+	}
+	if prev != nil {
+		ns.usage.Keys--
+		ns.usage.Bytes -= entrySize(prev)
+	}
+	if next != nil {
+		ns.usage.Keys++
+		ns.usage.Bytes += entrySize(next)
+	}
+}
+
+// Field tags of namespace limits, in commands and snapshots.
+const (
+	tagNamespaceName         byte = 1
+	tagNamespaceMaxKeys      byte = 2
+	tagNamespaceMaxBytes     byte = 3
+	tagNamespaceMaxValueSize byte = 4
+)
+
+func encodeNamespaceLimits(limits NamespaceLimits) []byte {
+	e := &encoder{}
+	e.int(tagNamespaceMaxKeys, limits.MaxKeys)
+	e.int(tagNamespaceMaxBytes, limits.MaxBytes)
+	e.int(tagNamespaceMaxValueSize, limits.MaxValueSize)
+	return e.buf
+}
+
+// decodeNamespace decodes namespace limits, and the name when present.
+func decodeNamespace(b []byte) (name string, limits NamespaceLimits, err error) {
+	d := &decoder{buf: b}
+	for {
+		tag, data, ok, err := d.next()
+		if err != nil {
+			return "", limits, err
+		}
+		if !ok {
+			return name, limits, nil
+		}
+		switch tag {
+		case tagNamespaceName:
+			name = string(data)
+		case tagNamespaceMaxKeys:
+			limits.MaxKeys, err = decodeInt(data)
+		case tagNamespaceMaxBytes:
+			limits.MaxBytes, err = decodeInt(data)
+		case tagNamespaceMaxValueSize:
+			limits.MaxValueSize, err = decodeInt(data)
+		}
+		if err != nil {
+			return "", limits, err
+		}
+	}
+}
+
+func decodeNamespaceLimits(b []byte) (NamespaceLimits, error) {
+	_, limits, err := decodeNamespace(b)
+	return limits, err
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestNamespaceQuota(t *testing.T) {
+	s := openTestStore(t)
+	if err := s.Set("team/old", []byte("12345")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetNamespace("bad/name", NamespaceLimits{}); !errors.Is(err, ErrInvalidNamespace) {
+		t.Fatalf("created a namespace with a separator in its name: %v", err)
+	}
+	if err := s.SetNamespace("team", NamespaceLimits{MaxKeys: 2, MaxValueSize: 10}); err != nil {
+		t.Fatal(err)
+	}
+	// A new namespace counts the keys it already holds.
+	if ns, err := s.Namespace("team"); err != nil || ns.Usage.Keys != 1 || ns.Usage.Bytes != int64(len("team/old")+5) {
+		t.Fatalf("namespace is %+v, %v", ns, err)
+	}
+
+	if err := s.Set("team/a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	var quota *QuotaError
+	if err := s.Set("team/b", []byte("1")); !errors.As(err, &quota) || quota.Limit != LimitKeys {
+		t.Fatalf("went past the key limit: %v", err)
+	}
+	if err := s.Set("team/a", bytes.Repeat([]byte("v"), 11)); !errors.As(err, &quota) || quota.Limit != LimitValueSize {
+		t.Fatalf("went past the value size limit: %v", err)
+	}
+	// Keys out of the namespace are not limited, and replacing a key does
+	// not add one.
+	if err := s.Set("other", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("team/a", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNamespaceSnapshot(t *testing.T) {
+	s := openTestStore(t)
+	limits := NamespaceLimits{MaxKeys: 10, MaxBytes: 1000}
+	if err := s.SetNamespace("team", limits); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("team/a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	want, err := s.Namespace("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := snapshotOf(t, s)
+	// Nodes that predate namespaces would drop their limits, so they must
+	// refuse the snapshot.
+	if v := data[len(snapshotMagic)]; v != snapshotNamespacesVersion {
+		t.Fatalf("snapshot with namespaces written as version %d, want %d", v, snapshotNamespacesVersion)
+	}
+	if err := s.DeleteNamespace("team"); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*fsm)(s).Restore(io.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Namespace("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *want {
+		t.Fatalf("namespace restored as %+v, want %+v", got, want)
+	}
+}
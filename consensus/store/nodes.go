@@ -0,0 +1,141 @@
+package store
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+
+	"go.uber.org/zap"
+)
+
+// NotLeaderError is returned by operations that must run on the leader when
+// they are sent to another node. It names the current leader, if known, so
+// that the request can be sent there instead.
+type NotLeaderError struct {
+	LeaderID      string `json:"leader_id,omitempty"`
+	LeaderAddr    string `json:"leader_addr,omitempty"`
+	LeaderAPIAddr string `json:"leader_api_addr,omitempty"`
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.LeaderAPIAddr == "" {
+		return ErrNotLeader.Error()
+	}
+	return fmt.Sprintf("%s, leader is %s at %s", ErrNotLeader, e.LeaderID, e.LeaderAPIAddr)
+}
+
+// Is makes errors.Is(err, ErrNotLeader) hold for a *NotLeaderError.
+func (e *NotLeaderError) Is(target error) bool {
+	return target == ErrNotLeader
+}
+
+// NodeMeta is what a node publishes about itself through Raft.
+type NodeMeta struct {
+	// APIAddr is the address of the HTTP API of the node.
+	APIAddr string `json:"api_addr,omitempty"`
+
+	// CommandVersion is the newest command version the node applies.
+	CommandVersion uint64 `json:"command_version,omitempty"`
+
+	// Ops are the command ops the node applies. Nodes that predate the
+	// feature gate publish none.
+	Ops []string `json:"ops,omitempty"`
+}
+
+// LocalNodeMeta returns the metadata this node publishes.
+func (s *Store) LocalNodeMeta() NodeMeta {
+	return NodeMeta{
+		APIAddr:        s.HTTPAddr,
+		CommandVersion: CommandVersion,
+		Ops:            s.SupportedOps(),
+	}
+}
+
+// notLeader returns the error for an operation that reached a follower.
+func (s *Store) notLeader() error {
+	addr, id := s.raft.LeaderWithID()
+	return &NotLeaderError{
+		LeaderID:      string(id),
+		LeaderAddr:    string(addr),
+		LeaderAPIAddr: s.NodeAPIAddr(string(id)),
+	}
+}
+
+// LeaderAPIAddr returns the HTTP API address of the current leader, or an
+// empty string if there is no leader or its address is not known yet.
+func (s *Store) LeaderAPIAddr() string {
+	_, id := s.raft.LeaderWithID()
+	return s.NodeAPIAddr(string(id))
+}
+
+// NodeAPIAddr returns the HTTP API address registered by a node.
+func (s *Store) NodeAPIAddr(nodeID string) string {
+	if nodeID == "" {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nodes[nodeID].APIAddr
+}
+
+// registerNode records, through Raft, the metadata of a node if it is not
+// registered yet or has changed. raftAddr supplies the host when the API
+// address is only a port, such as ":11000".
+func (s *Store) registerNode(nodeID, raftAddr string, meta NodeMeta) error {
+	meta.APIAddr = advertiseAddr(meta.APIAddr, raftAddr)
+	if meta.APIAddr == "" && len(meta.Ops) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	current, ok := s.nodes[nodeID]
+	s.mu.Unlock()
+	if ok && reflect.DeepEqual(current, meta) {
+		return nil
+	}
+	_, err := s.apply(&command{
+		Op:          "node",
+		Key:         nodeID,
+		Value:       []byte(meta.APIAddr),
+		NodeVersion: meta.CommandVersion,
+		NodeOps:     meta.Ops,
+	})
+	return err
+}
+
+// registerSelf registers the metadata of this node. It runs while the node
+// leads; followers are registered when they join.
+func (s *Store) registerSelf() {
+	funcDesc := "store - registerSelf"
+
+	if err := s.registerNode(s.localID, s.RaftBind, s.LocalNodeMeta()); err != nil {
+		zap.L().Error(
+			funcDesc,
+			zap.String("type", "failed to register node"),
+			zap.String("msg", err.Error()),
+		)
+	}
+}
+
+// advertiseAddr returns the address other nodes should use to reach apiAddr.
+// An address without a host takes the host of the node's Raft address.
+func advertiseAddr(apiAddr, raftAddr string) string {
+	host, port, err := net.SplitHostPort(apiAddr)
+	if err != nil || host != "" {
+		return apiAddr
+	}
+	raftHost, _, err := net.SplitHostPort(raftAddr)
+	if err != nil || raftHost == "" {
+		return apiAddr
+	}
+	return net.JoinHostPort(raftHost, port)
+}
+
+// applyNode records the metadata of a node. The caller must hold f.mu.
+func (f *fsm) applyNode(c *command) interface{} {
+	f.nodes[c.Key] = NodeMeta{
+		APIAddr:        string(c.Value),
+		CommandVersion: c.NodeVersion,
+		Ops:            c.NodeOps,
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+// A cluster that lost the majority of its voters cannot elect a leader, and
+// so cannot remove the lost voters either. Recovery mode is the way out: an
+// operator stops every surviving node, gives each one the same list of
+// servers, either in a peers file in the Raft directory or through
+// RecoverPeers, and starts them again. Each node then rewrites its Raft
+// configuration to that list before it opens, and the survivors elect a
+// leader among themselves. Writes the lost voters had and the survivors
+// did not are lost with them.
+//
+// PeersFile is the name of the file, in the Raft directory, that starts a
+// node in recovery mode. It holds the surviving servers in the format of
+// raft.ReadConfigJSON:
+//
+//	[
+//	  {"id": "node1", "address": "10.0.0.1:12000"},
+//	  {"id": "node2", "address": "10.0.0.2:12000", "non_voter": false}
+//	]
+//
+// It is deleted once the configuration is recovered, so that a later
+// restart does not recover it again.
+const PeersFile = "peers.json"
+
+// recoveredPeersKey is the key, in the stable store, of the RecoverPeers the
+// node was last recovered with, so that they are recovered only once.
+var recoveredPeersKey = []byte("RecoveredPeers")
+
+// ErrInvalidPeers is returned when the servers to recover are malformed.
+var ErrInvalidPeers = errors.New("invalid recovery peers")
+
+// ParsePeers parses servers to recover given as "id=address", e.g.
+// "node1=10.0.0.1:12000". They are all voters.
+func ParsePeers(peers []string) ([]Server, error) {
+	var servers []Server
+	for _, p := range peers {
+		id, addr, ok := strings.Cut(p, "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("%w: %q is not id=address", ErrInvalidPeers, p)
+		}
+		servers = append(servers, Server{ID: id, Address: addr, Suffrage: raft.Voter.String()})
+	}
+	return servers, nil
+}
+
+// recoveryConfiguration returns the Raft configuration to recover, with a
+// description of where it comes from, or nil if this node starts normally.
+func (s *Store) recoveryConfiguration() (*raft.Configuration, string, error) {
+	if len(s.RecoverPeers) > 0 {
+		var c raft.Configuration
+		for _, srv := range s.RecoverPeers {
+			suffrage := raft.Voter
+			if srv.Suffrage == raft.Nonvoter.String() {
+				suffrage = raft.Nonvoter
+			}
+			c.Servers = append(c.Servers, raft.Server{
+				Suffrage: suffrage,
+				ID:       raft.ServerID(srv.ID),
+				Address:  raft.ServerAddress(srv.Address),
+			})
+		}
+		return &c, "the configured recovery peers", nil
+	}
+
+	if s.RaftDir == "" {
+		return nil, "", nil
+	}
+	path := filepath.Join(s.RaftDir, PeersFile)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	c, err := raft.ReadConfigJSON(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %s: %v", ErrInvalidPeers, path, err)
+	}
+	return &c, path, nil
+}
+
+// recover rewrites the Raft configuration of this node if it starts in
+// recovery mode. It runs before Raft is started on the same stores. What it
+// does is logged as errors, so that it shows at any log level.
+func (s *Store) recover(config *raft.Config, logs raft.LogStore, stable raft.StableStore, snapshots raft.SnapshotStore, transport raft.Transport) error {
+	funcDesc := "store - recover"
+
+	configuration, source, err := s.recoveryConfiguration()
+	if err != nil || configuration == nil {
+		return err
+	}
+
+	found := false
+	for _, srv := range configuration.Servers {
+		found = found || srv.ID == config.LocalID
+	}
+	if !found {
+		return fmt.Errorf("%w: this node, %s, is not among them", ErrInvalidPeers, config.LocalID)
+	}
+
+	// RecoverPeers stay set until the operator removes them, so a restart
+	// with the ones already recovered keeps the configuration the cluster
+	// has moved on to. A read error of the stable store recovers again.
+	peers, err := json.Marshal(s.RecoverPeers)
+	if err != nil {
+		return err
+	}
+	if len(s.RecoverPeers) > 0 {
+		if done, err := stable.Get(recoveredPeersKey); err == nil && bytes.Equal(done, peers) {
+			zap.L().Error(
+				funcDesc,
+				zap.String("type", "RECOVERY MODE"),
+				zap.String("msg", fmt.Sprintf("%s was already recovered with these servers, starting normally; remove the recovery peers", config.LocalID)),
+			)
+			return nil
+		}
+	}
+
+	r, err := s.recoveryStore()
+	if err != nil {
+		return err
+	}
+	defer r.m.Close()
+
+	zap.L().Error(
+		funcDesc,
+		zap.String("type", "RECOVERY MODE"),
+		zap.String("msg", fmt.Sprintf("replacing the raft configuration of %s with the %d servers of %s, any other server is dropped", config.LocalID, len(configuration.Servers), source)),
+	)
+	for _, srv := range configuration.Servers {
+		zap.L().Error(
+			funcDesc,
+			zap.String("type", "RECOVERY MODE"),
+			zap.String("msg", fmt.Sprintf("recovering %s %s at %s", srv.Suffrage, srv.ID, srv.Address)),
+		)
+	}
+
+	snapshots = &snapshotStore{SnapshotStore: snapshots, f: (*fsm)(r)}
+	if err := raft.RecoverCluster(config, (*fsm)(r), logs, stable, snapshots, transport, *configuration); err != nil {
+		zap.L().Error(
+			funcDesc,
+			zap.String("type", "RECOVERY MODE"),
+			zap.String("msg", fmt.Sprintf("failed to recover the raft configuration: %s", err)),
+		)
+		return fmt.Errorf("recover cluster: %w", err)
+	}
+
+	if len(s.RecoverPeers) == 0 {
+		if err := os.Remove(source); err != nil {
+			return fmt.Errorf("recovered, but failed to delete %s, delete it before the next start: %w", source, err)
+		}
+	} else if err := stable.Set(recoveredPeersKey, peers); err != nil {
+		return fmt.Errorf("recovered, but failed to record it, remove the recovery peers before the next start: %w", err)
+	}
+	zap.L().Error(
+		funcDesc,
+		zap.String("type", "RECOVERY MODE"),
+		zap.String("msg", fmt.Sprintf("recovered the raft configuration from %s; start the other survivors with the same servers", source)),
+	)
+	return nil
+}
+
+// recoveryStore returns the store raft.RecoverCluster replays the log into,
+// which is thrown away afterwards: an in-memory store with subsystems of its
+// own, so that the replay writes neither the backend nor the sections of s.
+// Raft then restores s from the snapshot RecoverCluster takes.
+func (s *Store) recoveryStore() (*Store, error) {
+	r := New(true)
+	r.CompressSnapshots = s.CompressSnapshots
+	for _, register := range s.subsystems {
+		if err := register(r); err != nil {
+			return nil, fmt.Errorf("recover cluster: %w", err)
+		}
+	}
+	for op := range s.handlers {
+		if _, ok := r.handlers[op]; !ok {
+			return nil, fmt.Errorf("recover cluster: op %q was not registered through RegisterSubsystem, so the log cannot be replayed", op)
+		}
+	}
+	for name := range s.sections {
+		if _, ok := r.sections[name]; !ok {
+			return nil, fmt.Errorf("recover cluster: section %q was not registered through RegisterSubsystem, so the log cannot be replayed", name)
+		}
+	}
+	return r, nil
+}
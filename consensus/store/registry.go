@@ -0,0 +1,162 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Subsystems replicate their own state through the store by registering the
+// ops they apply and the sections they save in snapshots:
+//
+//	s := store.New(false)
+//	var sched *scheduler
+//	s.RegisterSubsystem(func(s *store.Store) error {
+//		sched = newScheduler()
+//		if err := s.Register("scheduler.assign", sched.applyAssign); err != nil {
+//			return err
+//		}
+//		return s.RegisterSection("scheduler", sched)
+//	})
+//	s.Open(enableSingle, nodeID)
+//	...
+//	resp, err := s.Propose("scheduler.assign", payload)
+//
+// Handlers and sections run on every node, in log order, while the store
+// lock is held. They must be deterministic and must not call back into the
+// Store.
+
+// ErrRegistryClosed is returned when an op or a section is registered after
+// the store was opened.
+var ErrRegistryClosed = errors.New("ops and sections must be registered before Open")
+
+// CommandHandler applies the payload of a registered op. index is the index
+// of its log entry, also the revision of the store once it is applied. The
+// result, or the error, is returned by Propose on the leader.
+type CommandHandler func(index uint64, payload []byte) (interface{}, error)
+
+// Section is replicated state kept by a subsystem and saved in snapshots.
+type Section interface {
+	// Snapshot returns the state as of the last applied entry. It runs
+	// between log entries, so it must be cheap.
+	Snapshot() ([]byte, error)
+
+	// Restore decodes data returned by Snapshot and returns a function that
+	// replaces the state with it. data is nil when the snapshot holds no
+	// such section, which resets the state. Restore itself must leave the
+	// state unchanged, so that a snapshot is restored to every section or
+	// to none.
+	Restore(data []byte) (commit func(), err error)
+}
+
+// Register registers the handler of op. op must not be one of the ops of
+// the store, such as "set".
+func (s *Store) Register(op string, handler CommandHandler) error {
+	if s.raft != nil {
+		return ErrRegistryClosed
+	}
+	if op == "" || contains(legacyOps, op) || contains(builtinOps, op) {
+		return fmt.Errorf("op %q is reserved", op)
+	}
+	if _, ok := s.handlers[op]; ok {
+		return fmt.Errorf("op %q is already registered", op)
+	}
+	s.handlers[op] = handler
+	return nil
+}
+
+// RegisterSection registers a section saved in snapshots under name.
+func (s *Store) RegisterSection(name string, section Section) error {
+	if s.raft != nil {
+		return ErrRegistryClosed
+	}
+	if name == "" {
+		return fmt.Errorf("section name is empty")
+	}
+	if _, ok := s.sections[name]; ok {
+		return fmt.Errorf("section %q is already registered", name)
+	}
+	s.sections[name] = section
+	return nil
+}
+
+// RegisterSubsystem registers the ops and sections of a subsystem by calling
+// register on s. register must build the state of the subsystem afresh on
+// every call: recovery mode calls it again on a throwaway store it replays
+// the log into, and only ops and sections registered this way can be
+// recovered.
+func (s *Store) RegisterSubsystem(register func(s *Store) error) error {
+	if s.raft != nil {
+		return ErrRegistryClosed
+	}
+	if err := register(s); err != nil {
+		return err
+	}
+	s.subsystems = append(s.subsystems, register)
+	return nil
+}
+
+// Propose applies a registered op with the given payload through Raft and
+// returns the result of its handler.
+func (s *Store) Propose(op string, payload []byte) (interface{}, error) {
+	if _, ok := s.handlers[op]; !ok {
+		return nil, fmt.Errorf("%w: op %q is not registered", ErrUnsupportedCommand, op)
+	}
+	return s.apply(&command{
+		Op:      op,
+		Payload: payload,
+	})
+}
+
+// SupportedOps returns the ops this node applies, sorted.
+func (s *Store) SupportedOps() []string {
+	ops := append([]string(nil), legacyOps...)
+	ops = append(ops, builtinOps...)
+	for op := range s.handlers {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	return ops
+}
+
+// applyRegistered applies a command with a registered op. The caller must
+// hold f.mu.
+func (f *fsm) applyRegistered(handler CommandHandler, c *command, index uint64) interface{} {
+	resp, err := handler(index, c.Payload)
+	if err != nil {
+		return err
+	}
+	return resp
+}
+
+// snapshotSections returns the state of every registered section. The
+// caller must hold f.mu.
+func (f *fsm) snapshotSections() (map[string][]byte, error) {
+	sections := make(map[string][]byte, len(f.sections))
+	for name, section := range f.sections {
+		data, err := section.Snapshot()
+		if err != nil {
+			return nil, fmt.Errorf("snapshot of section %q: %w", name, err)
+		}
+		sections[name] = data
+	}
+	return sections, nil
+}
+
+// restoreSections restores every registered section from the sections read
+// from a snapshot, once all of them are decoded. Sections no handler is
+// registered for are dropped. The caller must hold f.mu.
+func (f *fsm) restoreSections(sections map[string][]byte) error {
+	commits := make([]func(), 0, len(f.sections))
+	for name, section := range f.sections {
+		commit, err := section.Restore(sections[name])
+		if err != nil {
+			return fmt.Errorf("restore of section %q: %w", name, err)
+		}
+		commits = append(commits, commit)
+	}
+	for _, commit := range commits {
+		commit()
+	}
+	return nil
+}
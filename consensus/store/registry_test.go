@@ -0,0 +1,187 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// counter is a section holding a sum, which its op adds to.
+type counter struct {
+	n    uint64
+	adds int  // Number of ops applied.
+	bad  bool // Whether Restore fails.
+}
+
+func (c *counter) add(index uint64, payload []byte) (interface{}, error) {
+	if len(payload) == 0 {
+		return nil, errors.New("nothing to add")
+	}
+	c.n += uint64(payload[0])
+	c.adds++
+	return c.n, nil
+}
+
+func (c *counter) Snapshot() ([]byte, error) {
+	return binary.AppendUvarint(nil, c.n), nil
+}
+
+func (c *counter) Restore(data []byte) (func(), error) {
+	if c.bad {
+		return nil, errors.New("bad section")
+	}
+	var n uint64
+	if data != nil {
+		var size int
+		if n, size = binary.Uvarint(data); size <= 0 {
+			return nil, errors.New("malformed section")
+		}
+	}
+	return func() { c.n = n }, nil
+}
+
+func TestRegistry(t *testing.T) {
+	c := &counter{}
+	s := openTestStore(t, func(s *Store) {
+		if err := s.Register("counter.add", c.add); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Register("set", c.add); err == nil {
+			t.Fatal("registered a builtin op")
+		}
+		if err := s.RegisterSection("counter", c); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if err := s.Register("counter.sub", c.add); err != ErrRegistryClosed {
+		t.Fatalf("registered an op after Open: %v", err)
+	}
+	if !contains(s.SupportedOps(), "counter.add") {
+		t.Fatal("counter.add is not published")
+	}
+
+	for _, n := range []byte{5, 3} {
+		if _, err := s.Propose("counter.add", []byte{n}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Propose("counter.add", nil); err == nil {
+		t.Fatal("the error of the handler was not returned")
+	}
+	if _, err := s.Propose("counter.sub", nil); !errors.Is(err, ErrUnsupportedCommand) {
+		t.Fatalf("proposed an unregistered op: %v", err)
+	}
+	if c.n != 8 {
+		t.Fatalf("counter is %d, want 8", c.n)
+	}
+
+	data := snapshotOf(t, s)
+	// Nodes that predate sections would drop them, so they must refuse
+	// the snapshot.
+	if v := data[len(snapshotMagic)]; v != snapshotSectionsVersion {
+		t.Fatalf("snapshot with sections written as version %d, want %d", v, snapshotSectionsVersion)
+	}
+	c.n = 100
+	if err := (*fsm)(s).Restore(io.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	if c.n != 8 {
+		t.Fatalf("counter restored as %d, want 8", c.n)
+	}
+}
+
+func TestRestoreSectionsAllOrNothing(t *testing.T) {
+	good, bad := &counter{}, &counter{}
+	s := openTestStore(t, func(s *Store) {
+		s.RegisterSection("good", good)
+		s.RegisterSection("bad", bad)
+	})
+	good.n, bad.n = 1, 2
+	data := snapshotOf(t, s)
+
+	good.n, bad.n, bad.bad = 10, 20, true
+	if err := (*fsm)(s).Restore(io.NopCloser(bytes.NewReader(data))); err == nil {
+		t.Fatal("restored a section that failed to decode")
+	}
+	if good.n != 10 || bad.n != 20 {
+		t.Fatalf("sections are %d and %d after a failed restore, want 10 and 20", good.n, bad.n)
+	}
+
+	bad.bad = false
+	if err := (*fsm)(s).Restore(io.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	if good.n != 1 || bad.n != 2 {
+		t.Fatalf("sections restored as %d and %d, want 1 and 2", good.n, bad.n)
+	}
+}
+
+func TestRecoverSubsystem(t *testing.T) {
+	var c *counter
+	register := func(s *Store) error {
+		c = &counter{}
+		if err := s.Register("counter.add", c.add); err != nil {
+			return err
+		}
+		return s.RegisterSection("counter", c)
+	}
+	s := openTestStore(t, func(s *Store) {
+		if err := s.RegisterSubsystem(register); err != nil {
+			t.Fatal(err)
+		}
+	})
+	for _, n := range []byte{5, 3} {
+		if _, err := s.Propose("counter.add", []byte{n}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recovery replays the log into counters of its own, and the counter
+	// of the store only takes on the snapshot recovery took.
+	r := New(true)
+	r.LogStore, r.StableStore, r.SnapshotStore = s.LogStore, s.StableStore, s.SnapshotStore
+	_, r.Transport = raft.NewInmemTransport("")
+	r.RecoverPeers = []Server{{ID: "node0", Address: string(r.Transport.LocalAddr()), Suffrage: "Voter"}}
+	// The first counter registered is the one of the store.
+	var live *counter
+	if err := r.RegisterSubsystem(func(s *Store) error {
+		err := register(s)
+		if live == nil {
+			live = c
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Open(false, "node0"); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if live == c {
+		t.Fatal("recovery did not register a counter of its own")
+	}
+	if live.adds != 0 || live.n != 8 {
+		t.Fatalf("counter of the store applied %d ops and holds %d, want 0 ops and 8", live.adds, live.n)
+	}
+	if c.adds != 2 {
+		t.Fatalf("recovery replayed %d ops, want 2", c.adds)
+	}
+
+	// Ops registered outside a subsystem cannot be replayed.
+	u := New(true)
+	u.LogStore, u.StableStore, u.SnapshotStore = s.LogStore, raft.NewInmemStore(), s.SnapshotStore
+	_, u.Transport = raft.NewInmemTransport("")
+	u.RecoverPeers = r.RecoverPeers
+	u.Register("counter.add", (&counter{}).add)
+	if err := u.Open(false, "node0"); err == nil {
+		u.Close()
+		t.Fatal("recovered with an op registered outside a subsystem")
+	}
+}
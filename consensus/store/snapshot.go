@@ -0,0 +1,601 @@
+package store
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/hashicorp/raft"
+)
+
+// Snapshots are written as a stream of records, so neither Persist nor
+// Restore holds an encoded copy of the whole store in memory:
+//
+//	header:  the magic "SAPSNAP", the format version, a flags byte and the
+//	         number of records as a big endian uint64
+//	records: a type byte, a uvarint length and the record data
+//	trailer: an end record holding the CRC-32C of the header and of every
+//	         record before it
+//
+// When snapshotFlagGzip is set, everything after the header is gzip
+// compressed. The checksum covers the uncompressed bytes. Snapshots written
+// before the streamed format, a JSON object of keys to values, are still
+// restored.
+const (
+	snapshotMagic           = "SAPSNAP"
+	snapshotFlagGzip   byte = 1 << 0
+	snapshotHeaderSize      = len(snapshotMagic) + 2 + 8
+)
+
+// Versions of the streamed format. Readers skip the record types they do
+// not know, so every version that adds state other nodes must not drop gets
+// a new number. A snapshot is written with the oldest version that holds
+// its records, and readers refuse the versions after theirs.
+const (
+	// snapshotStreamVersion is the first streamed format.
+	snapshotStreamVersion byte = 3
+
+	// snapshotSectionsVersion adds the sections of registered subsystems.
+	snapshotSectionsVersion byte = 4
+
+	// snapshotNamespacesVersion adds namespace limits.
+	snapshotNamespacesVersion byte = 5
+
+	// snapshotLatestVersion is the newest version this node reads.
+	snapshotLatestVersion = snapshotNamespacesVersion
+)
+
+// Record types of a streamed snapshot. Leases and namespaces are written
+// before entries so that keys can be attached to their lease and counted in
+// their namespace as they are restored.
+const (
+	recordEnd      byte = 0
+	recordRevision byte = 1
+	recordLease    byte = 2
+	recordNode     byte = 3
+	recordEntry    byte = 4
+	recordSection  byte = 5
+
+	recordNamespace byte = 6
+)
+
+// Field tags of entry, lease and node records.
+const (
+	tagEntryKey            byte = 1
+	tagEntryValue          byte = 2
+	tagEntryCreateRevision byte = 3
+	tagEntryModRevision    byte = 4
+	tagEntryVersion        byte = 5
+	tagEntryLease          byte = 6
+
+	tagLeaseID  byte = 1
+	tagLeaseTTL byte = 2
+
+	tagNodeID          byte = 1
+	tagNodeAddr        byte = 2
+	tagNodeMetaVersion byte = 3
+	tagNodeMetaOp      byte = 4 // Repeated, once per op.
+
+	tagSectionName byte = 1
+	tagSectionData byte = 2
+)
+
+// restoreBatchSize is the number of entries of a snapshot written to the
+// backend per transaction.
+const restoreBatchSize = 4096
+
+// maxSnapshotRecordSize bounds a single record, so that a corrupt length
+// cannot make Restore allocate without limit.
+const maxSnapshotRecordSize = 1 << 28
+
+// ErrCorruptSnapshot is returned when a snapshot is truncated, malformed or
+// does not match its checksum.
+var ErrCorruptSnapshot = errors.New("corrupt snapshot")
+
+var snapshotCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// fsmState is the replicated state of the store, as read from a snapshot.
+// A state without a backend only checks the snapshot and drops its entries.
+type fsmState struct {
+	revision uint64
+	m        backend
+	leases   map[int64]*lease
+	nodes    map[string]NodeMeta
+	sections map[string][]byte
+
+	namespaces map[string]*namespace
+
+	pending []*KeyValue // Entries not written to m yet.
+}
+
+func newFSMState(b backend) *fsmState {
+	return &fsmState{
+		m:          b,
+		leases:     make(map[int64]*lease),
+		nodes:      make(map[string]NodeMeta),
+		sections:   make(map[string][]byte),
+		namespaces: make(map[string]*namespace),
+	}
+}
+
+// insert adds an entry, attaching it to its lease. Entries are written to
+// the backend in batches, the last one by flush.
+func (st *fsmState) insert(kv *KeyValue) error {
+	if st.m == nil {
+		return nil
+	}
+	if l, ok := st.leases[kv.Lease]; ok {
+		l.keys[kv.Key] = struct{}{}
+	}
+	account(st.namespaces, nil, kv)
+	st.pending = append(st.pending, kv)
+	if len(st.pending) < restoreBatchSize {
+		return nil
+	}
+	return st.flush()
+}
+
+// flush writes the pending entries to the backend in one transaction.
+func (st *fsmState) flush() error {
+	if len(st.pending) == 0 {
+		return nil
+	}
+	err := st.m.Update(func(tx backendTx) error {
+		for _, kv := range st.pending {
+			if err := tx.Put(kv); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	st.pending = st.pending[:0]
+	return err
+}
+
+type fsmSnapshot struct {
+	revision uint64
+	entries  backendView
+	leases   []Lease
+	nodes    map[string]NodeMeta
+	sections map[string][]byte
+	compress bool
+
+	namespaces map[string]NamespaceLimits
+}
+
+func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	err := func() error {
+		w := bufio.NewWriter(sink)
+		if err := f.write(w); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		// Close the sink.
+		return sink.Close()
+	}()
+
+	if err != nil {
+		sink.Cancel()
+	}
+
+	return err
+}
+
+func (f *fsmSnapshot) Release() {
+	f.entries.Release()
+}
+
+// snapshotStore tells the FSM the index of the snapshot Raft opens, which
+// Restore is not given. Raft opens every snapshot it restores through it.
+type snapshotStore struct {
+	raft.SnapshotStore
+	f *fsm
+}
+
+func (s *snapshotStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	meta, rc, err := s.SnapshotStore.Open(id)
+	if err == nil {
+		s.f.restoreIndex.Store(meta.Index)
+	}
+	return meta, rc, err
+}
+
+// version returns the oldest format version that holds the records of the
+// snapshot, so that nodes not upgraded yet can restore it unless it holds
+// state they would drop.
+func (f *fsmSnapshot) version() byte {
+	if len(f.namespaces) > 0 {
+		return snapshotNamespacesVersion
+	}
+	if len(f.sections) > 0 {
+		return snapshotSectionsVersion
+	}
+	return snapshotStreamVersion
+}
+
+// write streams the snapshot to w.
+func (f *fsmSnapshot) write(w io.Writer) error {
+	var flags byte
+	if f.compress {
+		flags |= snapshotFlagGzip
+	}
+	count := uint64(1 + len(f.leases) + len(f.nodes) + len(f.sections) + len(f.namespaces) + f.entries.Len())
+
+	header := append([]byte(snapshotMagic), f.version(), flags)
+	header = binary.BigEndian.AppendUint64(header, count)
+	crc := crc32.New(snapshotCRCTable)
+	crc.Write(header)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	body := w
+	var gz *gzip.Writer
+	if f.compress {
+		gz = gzip.NewWriter(w)
+		body = gz
+	}
+	sw := &snapshotWriter{w: body, crc: crc}
+
+	if err := sw.record(recordRevision, binary.AppendUvarint(nil, f.revision)); err != nil {
+		return err
+	}
+	for _, l := range f.leases {
+		e := &encoder{}
+		e.int(tagLeaseID, l.ID)
+		e.int(tagLeaseTTL, l.TTL)
+		if err := sw.record(recordLease, e.buf); err != nil {
+			return err
+		}
+	}
+	ids := make([]string, 0, len(f.nodes))
+	for id := range f.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		e := &encoder{}
+		meta := f.nodes[id]
+		e.string(tagNodeID, id)
+		e.string(tagNodeAddr, meta.APIAddr)
+		e.uint(tagNodeMetaVersion, meta.CommandVersion)
+		for _, op := range meta.Ops {
+			e.string(tagNodeMetaOp, op)
+		}
+		if err := sw.record(recordNode, e.buf); err != nil {
+			return err
+		}
+	}
+	names := make([]string, 0, len(f.sections))
+	for name := range f.sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		e := &encoder{}
+		e.string(tagSectionName, name)
+		e.bytes(tagSectionData, f.sections[name])
+		if err := sw.record(recordSection, e.buf); err != nil {
+			return err
+		}
+	}
+	names = names[:0]
+	for name := range f.namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		e := &encoder{}
+		e.string(tagNamespaceName, name)
+		e.buf = append(e.buf, encodeNamespaceLimits(f.namespaces[name])...)
+		if err := sw.record(recordNamespace, e.buf); err != nil {
+			return err
+		}
+	}
+	var err error
+	if aerr := f.entries.Ascend("", func(kv *KeyValue) bool {
+		err = sw.record(recordEntry, encodeKeyValue(kv))
+		return err == nil
+	}); aerr != nil {
+		return aerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := sw.record(recordEnd, binary.BigEndian.AppendUint32(nil, crc.Sum32())); err != nil {
+		return err
+	}
+	if gz != nil {
+		return gz.Close()
+	}
+	return nil
+}
+
+// snapshotWriter writes records and keeps the running checksum.
+type snapshotWriter struct {
+	w   io.Writer
+	crc hash.Hash32
+	buf []byte
+}
+
+func (sw *snapshotWriter) record(typ byte, data []byte) error {
+	sw.buf = append(sw.buf[:0], typ)
+	sw.buf = binary.AppendUvarint(sw.buf, uint64(len(data)))
+	sw.buf = append(sw.buf, data...)
+	sw.crc.Write(sw.buf)
+	_, err := sw.w.Write(sw.buf)
+	return err
+}
+
+func encodeKeyValue(kv *KeyValue) []byte {
+	e := &encoder{}
+	e.string(tagEntryKey, kv.Key)
+	if len(kv.Value) > 0 {
+		e.bytes(tagEntryValue, kv.Value)
+	}
+	e.uint(tagEntryCreateRevision, kv.CreateRevision)
+	e.uint(tagEntryModRevision, kv.ModRevision)
+	e.uint(tagEntryVersion, kv.Version)
+	e.int(tagEntryLease, kv.Lease)
+	return e.buf
+}
+
+func decodeKeyValue(b []byte) (*KeyValue, error) {
+	kv := &KeyValue{}
+	d := &decoder{buf: b}
+	for {
+		tag, data, ok, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return kv, nil
+		}
+		switch tag {
+		case tagEntryKey:
+			kv.Key = string(data)
+		case tagEntryValue:
+			kv.Value = data
+		case tagEntryCreateRevision:
+			kv.CreateRevision, err = decodeUint(data)
+		case tagEntryModRevision:
+			kv.ModRevision, err = decodeUint(data)
+		case tagEntryVersion:
+			kv.Version, err = decodeUint(data)
+		case tagEntryLease:
+			kv.Lease, err = decodeInt(data)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readSnapshot reads a snapshot in any supported format, storing its
+// entries in b. index is the Raft index of the snapshot, the revision of a
+// legacy snapshot, which does not hold one.
+func readSnapshot(r io.Reader, b backend, index uint64) (*fsmState, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(snapshotMagic)); err == nil && string(magic) == snapshotMagic {
+		return readSnapshotStream(br, b)
+	}
+
+	// Snapshots written before the streamed format are a JSON object of keys
+	// to string values, without revisions.
+	legacy := map[string]string{}
+	if err := json.NewDecoder(br).Decode(&legacy); err != nil {
+		return nil, err
+	}
+	st := newFSMState(b)
+	st.revision = index
+	for k, v := range legacy {
+		kv := &KeyValue{
+			Key:            k,
+			Value:          []byte(v),
+			CreateRevision: index,
+			ModRevision:    index,
+			Version:        1,
+		}
+		if err := st.insert(kv); err != nil {
+			return nil, err
+		}
+	}
+	if err := st.flush(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// readSnapshotStream reads a streamed snapshot. The state is only returned
+// once the record count and the checksum have been verified.
+func readSnapshotStream(r *bufio.Reader, b backend) (*fsmState, error) {
+	header := make([]byte, snapshotHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, corruptSnapshot(err)
+	}
+	version := header[len(snapshotMagic)]
+	if version < snapshotStreamVersion || version > snapshotLatestVersion {
+		return nil, fmt.Errorf("unsupported snapshot format version %d", version)
+	}
+	flags := header[len(snapshotMagic)+1]
+	if flags&^snapshotFlagGzip != 0 {
+		return nil, fmt.Errorf("unsupported snapshot flags %#x", flags)
+	}
+	count := binary.BigEndian.Uint64(header[len(snapshotMagic)+2:])
+	crc := crc32.New(snapshotCRCTable)
+	crc.Write(header)
+
+	body := r
+	if flags&snapshotFlagGzip != 0 {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, corruptSnapshot(err)
+		}
+		defer gz.Close()
+		body = bufio.NewReader(gz)
+	}
+
+	st := newFSMState(b)
+	prefix := make([]byte, 0, 1+binary.MaxVarintLen64)
+	for n := uint64(0); ; n++ {
+		typ, err := body.ReadByte()
+		if err != nil {
+			return nil, corruptSnapshot(err)
+		}
+		size, err := binary.ReadUvarint(body)
+		if err != nil {
+			return nil, corruptSnapshot(err)
+		}
+		if size > maxSnapshotRecordSize {
+			return nil, fmt.Errorf("%w: record of %d bytes", ErrCorruptSnapshot, size)
+		}
+		// Entries keep a reference to their data, so each record gets its
+		// own buffer.
+		data := make([]byte, size)
+		if _, err := io.ReadFull(body, data); err != nil {
+			return nil, corruptSnapshot(err)
+		}
+
+		if typ == recordEnd {
+			if n != count {
+				return nil, fmt.Errorf("%w: %d records, header announces %d", ErrCorruptSnapshot, n, count)
+			}
+			if len(data) != 4 || binary.BigEndian.Uint32(data) != crc.Sum32() {
+				return nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptSnapshot)
+			}
+			if body != r {
+				// Read the compressed stream to its end so that gzip checks
+				// its own trailer too.
+				if _, err := io.Copy(io.Discard, body); err != nil {
+					return nil, corruptSnapshot(err)
+				}
+			}
+			if err := st.flush(); err != nil {
+				return nil, err
+			}
+			return st, nil
+		}
+
+		prefix = append(prefix[:0], typ)
+		prefix = binary.AppendUvarint(prefix, size)
+		crc.Write(prefix)
+		crc.Write(data)
+		if err := st.readRecord(typ, data); err != nil {
+			return nil, corruptSnapshot(err)
+		}
+	}
+}
+
+// readRecord adds a snapshot record to the state. Unknown record types are
+// skipped.
+func (st *fsmState) readRecord(typ byte, data []byte) error {
+	switch typ {
+	case recordRevision:
+		rev, err := decodeUint(data)
+		if err != nil {
+			return err
+		}
+		st.revision = rev
+	case recordLease:
+		var id, ttl int64
+		d := &decoder{buf: data}
+		for {
+			tag, field, ok, err := d.next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			switch tag {
+			case tagLeaseID:
+				id, err = decodeInt(field)
+			case tagLeaseTTL:
+				ttl, err = decodeInt(field)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		st.leases[id] = newLease(id, ttl)
+	case recordNode:
+		var id string
+		var meta NodeMeta
+		d := &decoder{buf: data}
+		for {
+			tag, field, ok, err := d.next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			switch tag {
+			case tagNodeID:
+				id = string(field)
+			case tagNodeAddr:
+				meta.APIAddr = string(field)
+			case tagNodeMetaVersion:
+				if meta.CommandVersion, err = decodeUint(field); err != nil {
+					return err
+				}
+			case tagNodeMetaOp:
+				meta.Ops = append(meta.Ops, string(field))
+			}
+		}
+		st.nodes[id] = meta
+	case recordSection:
+		var name string
+		var section []byte
+		d := &decoder{buf: data}
+		for {
+			tag, field, ok, err := d.next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			switch tag {
+			case tagSectionName:
+				name = string(field)
+			case tagSectionData:
+				section = field
+			}
+		}
+		st.sections[name] = section
+	case recordNamespace:
+		name, limits, err := decodeNamespace(data)
+		if err != nil {
+			return err
+		}
+		st.namespaces[name] = &namespace{limits: limits}
+	case recordEntry:
+		kv, err := decodeKeyValue(data)
+		if err != nil {
+			return err
+		}
+		return st.insert(kv)
+	}
+	return nil
+}
+
+// corruptSnapshot reports a snapshot that ends early or holds a malformed
+// record.
+func corruptSnapshot(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: truncated", ErrCorruptSnapshot)
+	}
+	return fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+}
@@ -0,0 +1,146 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// snapshotOf writes a snapshot of s.
+func snapshotOf(t *testing.T, s *Store) []byte {
+	t.Helper()
+	snap, err := (*fsm)(s).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+	var buf bytes.Buffer
+	if err := snap.(*fsmSnapshot).write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		s := openTestStore(t, func(s *Store) { s.CompressSnapshots = compress })
+		l, err := s.Grant(time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Set("a", []byte{0, 1, 2}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SetWithLease("b", []byte("leased"), l.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Set("c", nil); err != nil {
+			t.Fatal(err)
+		}
+		data := snapshotOf(t, s)
+		if v := data[len(snapshotMagic)]; v != snapshotStreamVersion {
+			t.Fatalf("snapshot written as version %d, want %d", v, snapshotStreamVersion)
+		}
+		if flagged := data[len(snapshotMagic)+1]&snapshotFlagGzip != 0; flagged != compress {
+			t.Fatalf("gzip flag is %v, want %v", flagged, compress)
+		}
+
+		st, err := readSnapshot(bytes.NewReader(data), newMemoryBackend(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.revision != s.Revision() {
+			t.Fatalf("revision %d, want %d", st.revision, s.Revision())
+		}
+		if _, ok := st.leases[l.ID]; !ok {
+			t.Fatalf("lease %d not restored", l.ID)
+		}
+		if _, ok := st.leases[l.ID].keys["b"]; !ok {
+			t.Fatal("key b not attached to its lease")
+		}
+		for _, key := range []string{"a", "b", "c"} {
+			want, _ := s.Get(key, ReadOptions{})
+			got, err := st.m.Get(key)
+			if err != nil || got == nil {
+				t.Fatalf("%s not restored: %v", key, err)
+			}
+			if !bytes.Equal(got.Value, want.Value) || got.ModRevision != want.ModRevision ||
+				got.CreateRevision != want.CreateRevision || got.Version != want.Version || got.Lease != want.Lease {
+				t.Fatalf("%s restored as %+v, want %+v", key, got, want)
+			}
+		}
+	}
+}
+
+func TestSnapshotCorruption(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		s := openTestStore(t, func(s *Store) { s.CompressSnapshots = compress })
+		for i := 0; i < 10; i++ {
+			if err := s.Set(strings.Repeat("k", i+1), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data := snapshotOf(t, s)
+
+		corrupt := map[string][]byte{
+			"truncated":      data[:len(data)-3],
+			"header only":    data[:snapshotHeaderSize],
+			"flipped byte":   flip(data, len(data)/2),
+			"flipped last":   flip(data, len(data)-1),
+			"extra record":   recount(data, +1),
+			"missing record": recount(data, -1),
+		}
+		if !compress {
+			// Uncompressed, the checksum is the only guard of the values.
+			i := bytes.Index(data, []byte("value"))
+			corrupt["flipped value"] = flip(data, i)
+		}
+		for name, b := range corrupt {
+			if _, err := readSnapshot(bytes.NewReader(b), newMemoryBackend(), 0); !errors.Is(err, ErrCorruptSnapshot) {
+				t.Errorf("compress=%v, %s: got %v, want ErrCorruptSnapshot", compress, name, err)
+			}
+		}
+
+		b := append([]byte(nil), data...)
+		b[len(snapshotMagic)] = snapshotLatestVersion + 1
+		if _, err := readSnapshot(bytes.NewReader(b), newMemoryBackend(), 0); err == nil {
+			t.Errorf("compress=%v: read a snapshot of an unknown version", compress)
+		}
+	}
+}
+
+// flip returns a copy of b with the byte at i inverted.
+func flip(b []byte, i int) []byte {
+	c := append([]byte(nil), b...)
+	c[i] ^= 0xff
+	return c
+}
+
+// recount returns a copy of the snapshot b whose header announces delta more
+// records.
+func recount(b []byte, delta int) []byte {
+	c := append([]byte(nil), b...)
+	at := len(snapshotMagic) + 2
+	binary.BigEndian.PutUint64(c[at:], uint64(int(binary.BigEndian.Uint64(c[at:]))+delta))
+	return c
+}
+
+func TestLegacySnapshot(t *testing.T) {
+	st, err := readSnapshot(strings.NewReader(`{"a":"1","b":"2"}`), newMemoryBackend(), 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.revision != 42 {
+		t.Fatalf("revision %d, want the snapshot index 42", st.revision)
+	}
+	kv, err := st.m.Get("b")
+	if err != nil || kv == nil {
+		t.Fatalf("b not restored: %v", err)
+	}
+	if string(kv.Value) != "2" || kv.CreateRevision != 42 || kv.ModRevision != 42 || kv.Version != 1 {
+		t.Fatalf("b restored as %+v", kv)
+	}
+}
@@ -0,0 +1,76 @@
+package store
+
+import "strconv"
+
+// Status describes this node as seen by its store.
+type Status struct {
+	ID       string `json:"id"`
+	State    string `json:"state"`
+	LeaderID string `json:"leader_id"`
+
+	// LeaderAddr and LeaderAPIAddr are the Raft and HTTP API addresses of
+	// the leader, if known.
+	LeaderAddr    string `json:"leader_addr,omitempty"`
+	LeaderAPIAddr string `json:"leader_api_addr,omitempty"`
+
+	// Term is the current Raft term of this node.
+	Term uint64 `json:"term"`
+
+	// LastIndex, CommitIndex and AppliedIndex are the indexes of the last
+	// entry in the log of this node, the last entry it knows committed and
+	// the last entry it applied.
+	LastIndex    uint64 `json:"last_index"`
+	CommitIndex  uint64 `json:"commit_index"`
+	AppliedIndex uint64 `json:"applied_index"`
+
+	// Revision is the index of the last log entry applied to the store.
+	Revision uint64 `json:"revision"`
+
+	// LastSnapshot is the most recent snapshot of this node, if any.
+	LastSnapshot *SnapshotMeta `json:"last_snapshot,omitempty"`
+
+	// Servers are the members of the latest Raft configuration known to
+	// this node.
+	Servers []Server `json:"servers"`
+
+	// Tuning is the Raft tuning the store runs with.
+	Tuning RaftTuning `json:"tuning"`
+
+	// Health is the health of every server, reported by the leader only.
+	Health []ServerHealth `json:"health,omitempty"`
+
+	// Stats are the internal statistics reported by Raft.
+	Stats map[string]string `json:"stats"`
+}
+
+// Status returns the status of this node.
+func (s *Store) Status() *Status {
+	addr, id := s.raft.LeaderWithID()
+	stats := s.raft.Stats()
+	term, _ := strconv.ParseUint(stats["term"], 10, 64)
+	status := &Status{
+		ID:            s.localID,
+		State:         s.raft.State().String(),
+		LeaderID:      string(id),
+		LeaderAddr:    string(addr),
+		LeaderAPIAddr: s.NodeAPIAddr(string(id)),
+		Term:          term,
+		LastIndex:     s.raft.LastIndex(),
+		CommitIndex:   s.raft.CommitIndex(),
+		AppliedIndex:  s.raft.AppliedIndex(),
+		Revision:      s.Revision(),
+		Tuning:        s.tuning,
+		Stats:         stats,
+	}
+
+	// Both only fail while Raft shuts down, and the rest of the status is
+	// still worth reporting then.
+	if snapshots, err := s.snapshots.List(); err == nil && len(snapshots) > 0 {
+		status.LastSnapshot = newSnapshotMeta(snapshots[0])
+	}
+	if servers, err := s.Servers(); err == nil {
+		status.Servers = servers
+	}
+	status.Health = s.Health()
+	return status
+}
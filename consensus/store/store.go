@@ -8,13 +8,15 @@
 package store
 
 import (
-	"encoding/json"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -23,35 +25,293 @@ import (
 	raftboltdb "github.com/hashicorp/raft-boltdb"
 )
 
+// Defaults of the RaftTuning fields Raft has no default for.
 const (
 	retainSnapshotCount = 2
 	raftTimeout         = 10 * time.Second
 )
 
+var (
+	// ErrNotLeader is returned when an operation that must run on the leader
+	// is sent to a follower.
+	ErrNotLeader = errors.New("not leader")
+
+	// ErrStaleRead is returned when a bounded-stale read is requested but this
+	// node has not heard from the leader within the requested bound.
+	ErrStaleRead = errors.New("stale read: leader contact exceeds max lag")
+)
+
+// ReadConsistency is the freshness guarantee requested for a read.
+type ReadConsistency int
+
+const (
+	// ReadDefault serves the read from local state without any checks. It is
+	// the cheapest level and may return stale data on followers or on a
+	// deposed leader.
+	ReadDefault ReadConsistency = iota
+
+	// ReadStale serves the read from local state as long as this node has
+	// heard from the leader within ReadOptions.MaxLag.
+	ReadStale
+
+	// ReadLinearizable serves the read on the leader only, after a Raft
+	// barrier has confirmed leadership and every preceding entry has been
+	// applied to the FSM.
+	ReadLinearizable
+)
+
+// String returns the name used for the level in the HTTP API.
+func (c ReadConsistency) String() string {
+	switch c {
+	case ReadStale:
+		return "stale"
+	case ReadLinearizable:
+		return "linearizable"
+	default:
+		return "default"
+	}
+}
+
+// ParseReadConsistency parses the name of a read consistency level. An empty
+// name selects ReadDefault.
+func ParseReadConsistency(name string) (ReadConsistency, error) {
+	switch name {
+	case "", "default":
+		return ReadDefault, nil
+	case "stale":
+		return ReadStale, nil
+	case "linearizable":
+		return ReadLinearizable, nil
+	default:
+		return ReadDefault, fmt.Errorf("unknown read consistency %q", name)
+	}
+}
+
+// ReadOptions controls how a read is served.
+type ReadOptions struct {
+	Consistency ReadConsistency
+
+	// MaxLag bounds how long ago this node may have last heard from the
+	// leader for a ReadStale read. Zero means no bound.
+	MaxLag time.Duration
+}
+
+// Reasons reported in a ConflictError.
+const (
+	ConflictValueMismatch = "value mismatch"
+	ConflictKeyExists     = "key exists"
+	ConflictKeyNotFound   = "key not found"
+
+	ConflictRevisionMismatch = "revision mismatch"
+)
+
+// ConflictError is returned by a conditional write whose condition did not
+// hold when the command was applied. Nothing is written in that case.
+type ConflictError struct {
+	Op     string `json:"op"`
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+
+	// Exists, Current and ModRevision describe the key as the FSM saw it.
+	Exists      bool   `json:"exists"`
+	Current     []byte `json:"current,omitempty"`
+	ModRevision uint64 `json:"mod_revision,omitempty"`
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s %q: %s", e.Op, e.Key, e.Reason)
+}
+
+// KeyValue is a key with its value and revision metadata. Revisions are
+// Raft log indexes.
+//
+// Values are arbitrary bytes, encoded as base64 in JSON.
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+
+	// CreateRevision is the revision at which the key was last created.
+	CreateRevision uint64 `json:"create_revision"`
+
+	// ModRevision is the revision of the last write to the key.
+	ModRevision uint64 `json:"mod_revision"`
+
+	// Version counts the writes to the key since it was created.
+	Version uint64 `json:"version"`
+
+	// Lease is the ID of the lease the key is attached to, if any.
+	Lease int64 `json:"lease,omitempty"`
+}
+
+// command is a change to the store carried by a log entry. See codec.go for
+// its encoding.
 type command struct {
-	Op    string `json:"op,omitempty"`
-	Key   string `json:"key,omitempty"`
-	Value string `json:"value,omitempty"`
+	Op    string
+	Key   string
+	Value []byte
+
+	// Version is the command version the entry was written with, 0 for
+	// entries that predate versioning, which are version 1.
+	Version uint64
+
+	// PrevValue is the expected value of a "cas" without PrevRevision.
+	PrevValue    []byte
+	PrevRevision *uint64
+
+	Lease int64
+	TTL   int64
+	Txn   *Txn
+
+	// Payload is the payload of an op registered with Register.
+	Payload []byte
+
+	// NodeVersion and NodeOps carry the metadata of a "node" command, whose
+	// Key is the node ID and Value its API address.
+	NodeVersion uint64
+	NodeOps     []string
+
+	// Batch holds the "set" and "delete" commands of a "batch" command.
+	Batch []*command
 }
 
 // Store is a simple key-value store, where all changes are made via Raft consensus.
 type Store struct {
 	RaftDir  string
 	RaftBind string
-	inmem    bool
-
-	mu sync.Mutex
-	m  map[string]string // The key-value store for the system.
-
-	raft *raft.Raft // The consensus mechanism
-
+	HTTPAddr string // Address of the HTTP API of this node.
+
+	// CompressSnapshots gzips the records of the snapshots taken by Raft.
+	CompressSnapshots bool
+
+	// Backend selects where the entries are kept, BackendMemory if empty.
+	Backend string
+
+	// BatchMaxSize is the largest number of writes proposed in a single log
+	// entry. Writes are not batched if it is 0 or 1.
+	BatchMaxSize int
+
+	// BatchDelay is how long a batch waits for more writes after its first
+	// one. If zero, a batch only holds the writes queued while the previous
+	// batch was committing.
+	BatchDelay time.Duration
+
+	// Tuning holds the Raft timings and limits, DefaultRaftTuning unless
+	// changed before Open.
+	Tuning RaftTuning
+
+	// VoterTarget is the number of voters the leader aims for. If set, nodes
+	// join as non-voters and the leader promotes them up to this number. If
+	// zero, every node joins as a voter.
+	VoterTarget int
+
+	// ServerStabilization is how long a non-voter must stay healthy before
+	// it is promoted, and a voter unreachable before it is demoted. Zero
+	// means 10 seconds.
+	ServerStabilization time.Duration
+
+	// MaxPromotionLag is how many revisions a non-voter may be behind the
+	// leader and still be promoted. Zero means 1024.
+	MaxPromotionLag uint64
+
+	// StatusOf, if set, returns the status of the node serving the HTTP API
+	// at the given address. The leader uses it to check that a non-voter
+	// has caught up before promoting it, so without it non-voters are never
+	// promoted.
+	StatusOf func(apiAddr string) (*Status, error)
+
+	// LiveMembers, if set, returns the IDs of the nodes the gossip layer
+	// sees alive. The leader removes the servers missing from it for
+	// DeadServerGrace, as long as the cluster keeps a safe quorum.
+	LiveMembers func() []string
+
+	// DeadServerGrace is how long a server may be missing from LiveMembers
+	// before it is removed. Zero means 5 minutes.
+	DeadServerGrace time.Duration
+
+	// MinQuorum is the fewest voters the leader leaves when it removes dead
+	// voters. Zero means no minimum beyond a healthy majority.
+	MinQuorum int
+
+	// RecoverPeers, if set, are the servers that survived the loss of the
+	// quorum. Open rewrites the Raft configuration of this node to them
+	// before it starts, as a peers file in RaftDir does. They are recovered
+	// once: an Open with the servers already recovered starts normally.
+	RecoverPeers []Server
+
+	// TLS, if set, runs the Raft transport bound to RaftBind over mutual TLS,
+	// so that only nodes with a certificate of the CA take part in the
+	// cluster. It has no effect if Transport is set.
+	TLS *TLSConfig
+
+	// Transport, if set, carries the Raft traffic of this node instead of a
+	// TCP transport bound to RaftBind.
+	Transport raft.Transport
+
+	// LogStore, StableStore and SnapshotStore, if set, replace the stores
+	// Open creates. Together with Transport they let a node run without
+	// ports or directories, as the nodes of a test cluster do.
+	LogStore      raft.LogStore
+	StableStore   raft.StableStore
+	SnapshotStore raft.SnapshotStore
+
+	inmem   bool
+	localID string
+	tuning  RaftTuning // Tuning as of Open.
+
+	mu       sync.Mutex
+	m        backend             // The key-value store for the system.
+	tx       *applyTx            // Write transaction of the entry being applied.
+	revision uint64              // Index of the last applied log entry.
+	leases   map[int64]*lease    // Leases by ID.
+	watches  *watchHub           // Watchers of key changes.
+	nodes    map[string]NodeMeta // Node metadata by node ID.
+
+	namespaces map[string]*namespace // Namespaces with limits, by name.
+
+	handlers map[string]CommandHandler // Handlers of registered ops.
+	sections map[string]Section        // Registered snapshot sections.
+
+	subsystems []func(*Store) error // Registration of the subsystems.
+
+	raft      *raft.Raft         // The consensus mechanism
+	snapshots raft.SnapshotStore // Snapshots taken by Raft.
+
+	// restoreIndex is the index of the snapshot Raft last opened, the one
+	// Restore reads.
+	restoreIndex atomic.Uint64
+
+	healthMu    sync.Mutex
+	health      map[raft.ServerID]serverHealth // Health of the servers, while leader.
+	leaderSince time.Time                      // When this node last acquired leadership.
+
+	observations chan raft.Observation // Heartbeat observations from Raft.
+	observer     *raft.Observer
+
+	batchCh    chan *pendingWrite // Writes waiting for the batcher.
+	leaderCh   chan bool          // Leadership changes notified by Raft.
+	shutdownCh chan struct{}      // Closed by Close to stop background work.
+	closeOnce  sync.Once
+	closeErr   error // Result of the first Close.
 }
 
 // New returns a new Store.
 func New(inmem bool) *Store {
 	return &Store{
-		m:     make(map[string]string),
-		inmem: inmem,
+		Tuning:     DefaultRaftTuning(),
+		m:          newMemoryBackend(),
+		leases:     make(map[int64]*lease),
+		watches:    newWatchHub(),
+		nodes:      make(map[string]NodeMeta),
+		namespaces: make(map[string]*namespace),
+		handlers:   make(map[string]CommandHandler),
+		sections:   make(map[string]Section),
+		inmem:      inmem,
+		health:     make(map[raft.ServerID]serverHealth),
+		batchCh:    make(chan *pendingWrite),
+		leaderCh:   make(chan bool, 1),
+		shutdownCh: make(chan struct{}),
+
+		observations: make(chan raft.Observation, 64),
 	}
 }
 
@@ -60,32 +320,65 @@ func New(inmem bool) *Store {
 // localID should be the server identifier for this node.
 func (s *Store) Open(enableSingle bool, localID string) error {
 	// Setup Raft configuration.
+	if err := s.Tuning.Validate(); err != nil {
+		return err
+	}
+	s.tuning = s.Tuning
 	config := raft.DefaultConfig()
+	s.tuning.apply(config)
 	config.LocalID = raft.ServerID(localID)
+	s.localID = localID
+	config.NotifyCh = s.leaderCh
 
 	// Setup Raft communication.
-	addr, err := net.ResolveTCPAddr("tcp", s.RaftBind)
-	if err != nil {
-		return err
+	transport := s.Transport
+	var stream *tlsStreamLayer
+	if transport == nil && s.TLS != nil {
+		var err error
+		if stream, err = newTLSStreamLayer(s.RaftBind, s.TLS); err != nil {
+			return err
+		}
+		transport = newTLSTransport(stream, 3, 10*time.Second)
 	}
-	transport, err := raft.NewTCPTransport(s.RaftBind, addr, 3, 10*time.Second, os.Stderr)
-	if err != nil {
+	if transport == nil {
+		addr, err := net.ResolveTCPAddr("tcp", s.RaftBind)
+		if err != nil {
+			return err
+		}
+		tcp, err := raft.NewTCPTransport(s.RaftBind, addr, 3, 10*time.Second, os.Stderr)
+		if err != nil {
+			return err
+		}
+		transport = tcp
+	}
+
+	// Setup the storage of the entries.
+	if err := s.openBackend(); err != nil {
 		return err
 	}
 
 	// Create the snapshot store. This allows the Raft to truncate the log.
-	snapshots, err := raft.NewFileSnapshotStore(s.RaftDir, retainSnapshotCount, os.Stderr)
-	if err != nil {
-		return fmt.Errorf("file snapshot store: %s", err)
+	snapshots := s.SnapshotStore
+	if snapshots == nil {
+		fss, err := raft.NewFileSnapshotStore(s.RaftDir, s.tuning.RetainSnapshots, os.Stderr)
+		if err != nil {
+			return fmt.Errorf("file snapshot store: %s", err)
+		}
+		snapshots = fss
 	}
 
 	// Create the log store and stable store.
-	var logStore raft.LogStore
-	var stableStore raft.StableStore
-	if s.inmem {
+	logStore := s.LogStore
+	stableStore := s.StableStore
+	switch {
+	case logStore != nil && stableStore != nil:
+		// Both were given by the caller.
+	case logStore != nil || stableStore != nil:
+		return fmt.Errorf("log store and stable store must be set together")
+	case s.inmem:
 		logStore = raft.NewInmemStore()
 		stableStore = raft.NewInmemStore()
-	} else {
+	default:
 		boltDB, err := raftboltdb.NewBoltStore(filepath.Join(s.RaftDir, "raft.db"))
 		if err != nil {
 			return fmt.Errorf("new bolt store: %s", err)
@@ -94,12 +387,23 @@ func (s *Store) Open(enableSingle bool, localID string) error {
 		stableStore = boltDB
 	}
 
+	// Rewrite the Raft configuration first if the node starts in recovery
+	// mode.
+	if err := s.recover(config, logStore, stableStore, snapshots, transport); err != nil {
+		return err
+	}
+	snapshots = &snapshotStore{SnapshotStore: snapshots, f: (*fsm)(s)}
+
 	// Instantiate the Raft systems.
 	ra, err := raft.NewRaft(config, (*fsm)(s), logStore, stableStore, snapshots, transport)
 	if err != nil {
 		return fmt.Errorf("new raft: %s", err)
 	}
 	s.raft = ra
+	s.snapshots = snapshots
+	if stream != nil {
+		stream.raft.Store(ra)
+	}
 
 	if enableSingle {
 		configuration := raft.Configuration{
@@ -113,64 +417,228 @@ func (s *Store) Open(enableSingle bool, localID string) error {
 		ra.BootstrapCluster(configuration)
 	}
 
+	// The observer does not block Raft; a dropped observation is made up
+	// for by the next heartbeat.
+	s.observer = raft.NewObserver(s.observations, false, isHeartbeatObservation)
+	ra.RegisterObserver(s.observer)
+	go s.observe()
+
+	go s.monitorLeadership()
+	if s.BatchMaxSize > 1 {
+		go s.runBatcher()
+	}
+
 	return nil
 }
 
-// Get returns the value for the given key.
-func (s *Store) Get(key string) (string, error) {
+// Close stops the leader duties of the store and shuts down Raft. Only the
+// first call does so, later calls return its result.
+func (s *Store) Close() error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.close()
+	})
+	return s.closeErr
+}
+
+func (s *Store) close() error {
+	close(s.shutdownCh)
+
+	s.mu.Lock()
+	s.watches.reset(s.revision)
+	s.mu.Unlock()
+
+	s.raft.DeregisterObserver(s.observer)
+	if err := s.raft.Shutdown().Error(); err != nil {
+		return err
+	}
+	return s.m.Close()
+}
+
+// isLeader reports whether this node is currently the Raft leader.
+func (s *Store) isLeader() bool {
+	return s.raft.State() == raft.Leader
+}
+
+// LeaderID returns the ID of the current leader as known by this node, or
+// an empty string if there is no leader.
+func (s *Store) LeaderID() string {
+	_, id := s.raft.LeaderWithID()
+	return string(id)
+}
+
+// Get returns the entry for the given key, served according to opts. It
+// returns nil if the key does not exist.
+func (s *Store) Get(key string, opts ReadOptions) (*KeyValue, error) {
+	if err := s.checkRead(opts); err != nil {
+		return nil, err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.m[key], nil
+	return s.m.Get(key)
 }
 
-// Set sets the value for the given key.
-func (s *Store) Set(key, value string) error {
-	if s.raft.State() != raft.Leader {
-		return fmt.Errorf("not leader")
+// Revision returns the index of the last log entry applied to the store.
+func (s *Store) Revision() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.revision
+}
+
+// checkRead verifies that local state is fresh enough to serve a read with
+// the given options.
+func (s *Store) checkRead(opts ReadOptions) error {
+	switch opts.Consistency {
+	case ReadDefault:
+		return nil
+
+	case ReadStale:
+		switch s.raft.State() {
+		case raft.Leader:
+			return nil
+		case raft.Follower:
+			if addr, _ := s.raft.LeaderWithID(); addr == "" {
+				return ErrStaleRead
+			}
+			if opts.MaxLag > 0 && time.Since(s.raft.LastContact()) > opts.MaxLag {
+				return ErrStaleRead
+			}
+			return nil
+		default:
+			return ErrStaleRead
+		}
+
+	case ReadLinearizable:
+		if !s.isLeader() {
+			return s.notLeader()
+		}
+		// The barrier only commits while we still hold leadership with a
+		// quorum, and it returns once every preceding entry has been applied
+		// to the FSM.
+		if err := s.raft.Barrier(s.tuning.ApplyTimeout).Error(); err != nil {
+			if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+				return s.notLeader()
+			}
+			return err
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown read consistency %d", opts.Consistency)
 	}
+}
 
-	c := &command{
+// Set sets the value for the given key.
+func (s *Store) Set(key string, value []byte) error {
+	return s.write(&command{
 		Op:    "set",
 		Key:   key,
 		Value: value,
-	}
-	b, err := json.Marshal(c)
-	if err != nil {
-		return err
-	}
-
-	f := s.raft.Apply(b, raftTimeout)
-	return f.Error()
+	})
 }
 
 // Delete deletes the given key.
 func (s *Store) Delete(key string) error {
-	if s.raft.State() != raft.Leader {
-		return fmt.Errorf("not leader")
-	}
-
-	c := &command{
+	return s.write(&command{
 		Op:  "delete",
 		Key: key,
+	})
+}
+
+// CompareAndSwap sets key to value only if its current value is expected.
+// A *ConflictError is returned if the key is missing or holds another value.
+func (s *Store) CompareAndSwap(key string, expected, value []byte) error {
+	_, err := s.apply(&command{
+		Op:        "cas",
+		Key:       key,
+		Value:     value,
+		PrevValue: expected,
+	})
+	return err
+}
+
+// CompareAndSwapRevision sets key to value only if its mod revision is
+// revision. A revision of 0 expects the key not to exist.
+func (s *Store) CompareAndSwapRevision(key string, revision uint64, value []byte) error {
+	_, err := s.apply(&command{
+		Op:           "cas",
+		Key:          key,
+		Value:        value,
+		PrevRevision: &revision,
+	})
+	return err
+}
+
+// Create sets key to value only if the key does not exist yet. A
+// *ConflictError is returned if it does.
+func (s *Store) Create(key string, value []byte) error {
+	_, err := s.apply(&command{
+		Op:    "create",
+		Key:   key,
+		Value: value,
+	})
+	return err
+}
+
+// Update sets key to value only if the key already exists. A *ConflictError
+// is returned if it does not.
+func (s *Store) Update(key string, value []byte) error {
+	_, err := s.apply(&command{
+		Op:    "update",
+		Key:   key,
+		Value: value,
+	})
+	return err
+}
+
+// apply proposes c through Raft and returns the response of the FSM. An
+// error returned by the FSM, such as a failed condition, is returned as err.
+func (s *Store) apply(c *command) (interface{}, error) {
+	if !s.isLeader() {
+		return nil, s.notLeader()
 	}
-	b, err := json.Marshal(c)
-	if err != nil {
-		return err
+
+	if c.Version == 0 {
+		c.Version = CommandVersion
+	}
+	if err := s.checkSupported(c); err != nil {
+		return nil, err
+	}
+	if err := s.checkQuota(c); err != nil {
+		return nil, err
 	}
 
-	f := s.raft.Apply(b, raftTimeout)
-	return f.Error()
+	f := s.raft.Apply(encodeCommand(c), s.tuning.ApplyTimeout)
+	if err := f.Error(); err != nil {
+		// The entry was not appended, so the caller can safely retry it on
+		// the new leader. Other errors leave the outcome unknown.
+		if err == raft.ErrNotLeader {
+			return nil, s.notLeader()
+		}
+		return nil, err
+	}
+	if err, ok := f.Response().(error); ok {
+		return nil, err
+	}
+	return f.Response(), nil
 }
 
 // Join joins a node, identified by nodeID and located at addr, to this store.
 // The node must be ready to respond to Raft communications at that address.
-func (s *Store) Join(nodeID, addr string) error {
+// meta is what the node publishes about itself, such as the address of its
+// HTTP API, used to forward requests to it when it leads, and the commands it
+// applies.
+func (s *Store) Join(nodeID, addr string, meta NodeMeta) error {
 	funcDesc := "store - Join"
 	zap.L().Info(
 		funcDesc,
 		zap.String("msg", fmt.Sprintf("received join request for remote node %s at %s", nodeID, addr)),
 	)
 
+	if !s.isLeader() {
+		return s.notLeader()
+	}
+
 	configFuture := s.raft.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
 		zap.L().Error(
@@ -192,7 +660,7 @@ func (s *Store) Join(nodeID, addr string) error {
 					funcDesc,
 					zap.String("msg", fmt.Sprintf("node %s at %s already member of cluster, ignoring join request", nodeID, addr)),
 				)
-				return nil
+				return s.registerNode(nodeID, addr, meta)
 			}
 
 			future := s.raft.RemoveServer(srv.ID, 0, 0)
@@ -202,102 +670,296 @@ func (s *Store) Join(nodeID, addr string) error {
 		}
 	}
 
-	f := s.raft.AddVoter(raft.ServerID(nodeID), raft.ServerAddress(addr), 0, 0)
+	// With a voter target the node starts as a non-voter, and the leader
+	// promotes it once it has caught up.
+	s.startHealth(raft.ServerID(nodeID))
+	suffrage := "voter"
+	var f raft.IndexFuture
+	if s.VoterTarget > 0 {
+		suffrage = "non-voter"
+		f = s.raft.AddNonvoter(raft.ServerID(nodeID), raft.ServerAddress(addr), 0, 0)
+	} else {
+		f = s.raft.AddVoter(raft.ServerID(nodeID), raft.ServerAddress(addr), 0, 0)
+	}
 	if f.Error() != nil {
 		return f.Error()
 	}
 	zap.L().Info(
 		funcDesc,
-		zap.String("msg", fmt.Sprintf("node %s at %s joined successfully", nodeID, addr)),
+		zap.String("msg", fmt.Sprintf("node %s at %s joined successfully as a %s", nodeID, addr, suffrage)),
 	)
-	return nil
+	return s.registerNode(nodeID, addr, meta)
 }
 
 type fsm Store
 
-// Apply applies a Raft log entry to the key-value store.
+// Apply applies a Raft log entry to the key-value store, in a single
+// transaction of the backend.
+// An entry that cannot be applied, such as one written by a newer binary,
+// is skipped with a *CommandError as its response. An entry the backend
+// fails to write stops the node: the entry is committed, so going on
+// without it would diverge from the other nodes.
 func (f *fsm) Apply(l *raft.Log) interface{} {
-	var c command
-	if err := json.Unmarshal(l.Data, &c); err != nil {
-		panic(fmt.Sprintf("failed to unmarshal command: %s", err.Error()))
+	funcDesc := "store - Apply"
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.revision = l.Index
+
+	var resp interface{}
+	err := f.m.Update(func(tx backendTx) error {
+		f.tx = &applyTx{backendTx: tx}
+		defer func() { f.tx = nil }()
+		resp = f.apply(l)
+		return f.tx.err
+	})
+	if err != nil {
+		zap.L().Panic(
+			funcDesc,
+			zap.String("type", "failed to write log entry to the backend"),
+			zap.Uint64("index", l.Index),
+			zap.String("msg", err.Error()),
+		)
+	}
+	return resp
+}
+
+// apply applies a log entry through f.tx. The caller must hold f.mu.
+func (f *fsm) apply(l *raft.Log) interface{} {
+	c, err := decodeCommand(l.Data)
+	if err != nil {
+		return f.reject(l, nil, fmt.Errorf("%w: %v", ErrMalformedCommand, err))
+	}
+	if c.Version > CommandVersion {
+		return f.reject(l, c, ErrUnsupportedCommand)
 	}
 
 	switch c.Op {
-	case "set":
-		return f.applySet(c.Key, c.Value)
-	case "delete":
-		return f.applyDelete(c.Key)
+	case "set", "delete":
+		return f.applyWrite(c, l.Index)
+	case "batch":
+		return f.applyBatch(l, c.Batch)
+	case "cas", "create", "update":
+		return f.applyConditional(c, l.Index)
+	case "txn":
+		return f.applyTxn(c.Txn, l.Index)
+	case "node":
+		return f.applyNode(c)
+	case "lease_grant":
+		return f.applyLeaseGrant(c.TTL, l.Index)
+	case "lease_revoke":
+		return f.applyLeaseRevoke(c.Lease, l.Index)
+	case "ns_set":
+		return f.applyNamespaceSet(c.Key, c.Payload)
+	case "ns_delete":
+		return f.applyNamespaceDelete(c.Key)
 	default:
-		panic(fmt.Sprintf("unrecognized command op: %s", c.Op))
+		if handler, ok := f.handlers[c.Op]; ok {
+			return f.applyRegistered(handler, c, l.Index)
+		}
+		return f.reject(l, c, ErrUnsupportedCommand)
 	}
 }
 
+// applyTx is the write transaction of a log entry. It keeps the first error
+// of the backend, which fails the whole entry whatever the apply functions
+// make of it.
+type applyTx struct {
+	backendTx
+	err error
+}
+
+func (t *applyTx) fail(err error) error {
+	if err != nil && t.err == nil {
+		t.err = err
+	}
+	return err
+}
+
+func (t *applyTx) Get(key string) (*KeyValue, error) {
+	kv, err := t.backendTx.Get(key)
+	return kv, t.fail(err)
+}
+
+func (t *applyTx) Put(kv *KeyValue) error {
+	return t.fail(t.backendTx.Put(kv))
+}
+
+func (t *applyTx) Delete(key string) (*KeyValue, error) {
+	kv, err := t.backendTx.Delete(key)
+	return kv, t.fail(err)
+}
+
+func (t *applyTx) Ascend(start string, fn func(kv *KeyValue) bool) error {
+	return t.fail(t.backendTx.Ascend(start, fn))
+}
+
 // Snapshot returns a snapshot of the key-value store.
 func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	// Clone the map.
-	o := make(map[string]string)
-	for k, v := range f.m {
-		o[k] = v
+	sections, err := f.snapshotSections()
+	if err != nil {
+		return nil, err
+	}
+
+	// The snapshot is persisted from a point-in-time view of the backend,
+	// while the store keeps applying entries.
+	view, err := f.m.View()
+	if err != nil {
+		return nil, err
+	}
+	leases := make([]Lease, 0, len(f.leases))
+	for _, l := range f.leases {
+		leases = append(leases, l.Lease)
 	}
-	return &fsmSnapshot{store: o}, nil
+	nodes := make(map[string]NodeMeta, len(f.nodes))
+	for id, meta := range f.nodes {
+		nodes[id] = meta
+	}
+	namespaces := make(map[string]NamespaceLimits, len(f.namespaces))
+	for name, ns := range f.namespaces {
+		namespaces[name] = ns.limits
+	}
+	return &fsmSnapshot{
+		revision: f.revision,
+		entries:  view,
+		leases:   leases,
+		nodes:    nodes,
+		sections: sections,
+		compress: f.CompressSnapshots,
+
+		namespaces: namespaces,
+	}, nil
 }
 
 // Restore stores the key-value store to a previous state.
 func (f *fsm) Restore(rc io.ReadCloser) error {
-	o := make(map[string]string)
-	if err := json.NewDecoder(rc).Decode(&o); err != nil {
+	b, err := (*Store)(f).newBackend()
+	if err != nil {
+		return err
+	}
+	state, err := readSnapshot(rc, b, f.restoreIndex.Load())
+	if err != nil {
+		b.Close()
 		return err
 	}
 
-	// Set the state from the snapshot, no lock required according to
-	// Hashicorp docs.
-	f.m = o
-	return nil
+	// Set the state from the snapshot. Reads may be in flight on the
+	// previous backend, so it is swapped under the lock.
+	f.mu.Lock()
+	if err := f.restoreSections(state.sections); err != nil {
+		f.mu.Unlock()
+		b.Close()
+		return err
+	}
+	prev := f.m
+	f.m = state.m
+	f.leases = state.leases
+	f.nodes = state.nodes
+	f.namespaces = state.namespaces
+	f.revision = state.revision
+	f.watches.reset(state.revision)
+	f.mu.Unlock()
+
+	return prev.Close()
 }
 
-func (f *fsm) applySet(key, value string) interface{} {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	f.m[key] = value
+// applySet stores value under key at the given revision, attached to the
+// given lease. The caller must hold f.mu.
+func (f *fsm) applySet(key string, value []byte, leaseID int64, revision uint64) error {
+	kv := &KeyValue{
+		Key:            key,
+		Value:          value,
+		CreateRevision: revision,
+		ModRevision:    revision,
+		Version:        1,
+		Lease:          leaseID,
+	}
+	prev, err := f.tx.Get(key)
+	if err != nil {
+		return err
+	}
+	var prevLease int64
+	if prev != nil {
+		kv.CreateRevision = prev.CreateRevision
+		kv.Version = prev.Version + 1
+		prevLease = prev.Lease
+	}
+	if err := f.tx.Put(kv); err != nil {
+		return err
+	}
+	account(f.namespaces, prev, kv)
+	f.attach(key, prevLease, leaseID)
+	f.watches.notify(Event{Type: EventPut, Key: key, Revision: revision, KV: kv})
 	return nil
 }
 
-func (f *fsm) applyDelete(key string) interface{} {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	delete(f.m, key)
+// applyDelete removes key at the given revision. The caller must hold f.mu.
+func (f *fsm) applyDelete(key string, revision uint64) error {
+	prev, err := f.tx.Delete(key)
+	if prev == nil {
+		return err
+	}
+	account(f.namespaces, prev, nil)
+	f.attach(key, prev.Lease, 0)
+	f.watches.notify(Event{Type: EventDelete, Key: key, Revision: revision})
 	return nil
 }
 
-type fsmSnapshot struct {
-	store map[string]string
-}
+// applyConditional sets the key of c if the condition implied by its op
+// holds, and returns a *ConflictError otherwise. The caller must hold f.mu.
+func (f *fsm) applyConditional(c *command, revision uint64) interface{} {
+	current, err := f.tx.Get(c.Key)
+	if err != nil {
+		return err
+	}
+	exists := current != nil
+	conflict := &ConflictError{
+		Op:     c.Op,
+		Key:    c.Key,
+		Exists: exists,
+	}
+	if exists {
+		conflict.Current = current.Value
+		conflict.ModRevision = current.ModRevision
+	}
 
-func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
-	err := func() error {
-		// Encode data.
-		b, err := json.Marshal(f.store)
-		if err != nil {
-			return err
+	switch c.Op {
+	case "cas":
+		switch {
+		case c.PrevRevision != nil:
+			// A missing key has revision 0, so an expected revision of 0
+			// only succeeds if the key does not exist.
+			if conflict.ModRevision != *c.PrevRevision {
+				conflict.Reason = ConflictRevisionMismatch
+				return conflict
+			}
+		case !exists:
+			conflict.Reason = ConflictKeyNotFound
+			return conflict
+		case !bytes.Equal(current.Value, c.PrevValue):
+			conflict.Reason = ConflictValueMismatch
+			return conflict
 		}
-
-		// Write data to sink.
-		if _, err := sink.Write(b); err != nil {
-			return err
+	case "create":
+		if exists {
+			conflict.Reason = ConflictKeyExists
+			return conflict
+		}
+	case "update":
+		if !exists {
+			conflict.Reason = ConflictKeyNotFound
+			return conflict
 		}
-
-		// Close the sink.
-		return sink.Close()
-	}()
-
-	if err != nil {
-		sink.Cancel()
 	}
 
-	return err
+	// A conditional write keeps the lease of the key it replaces, so that it
+	// cannot turn an ephemeral key into a permanent one.
+	var leaseID int64
+	if exists {
+		leaseID = current.Lease
+	}
+	return f.applySet(c.Key, c.Value, leaseID, revision)
 }
-
-func (f *fsmSnapshot) Release() {}
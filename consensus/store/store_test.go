@@ -0,0 +1,126 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// openTestStore opens a single node store that keeps everything in memory
+// and waits for it to lead. opts are applied before it opens.
+func openTestStore(t *testing.T, opts ...func(*Store)) *Store {
+	t.Helper()
+	s := New(true)
+	s.LogStore, s.StableStore = raft.NewInmemStore(), raft.NewInmemStore()
+	s.SnapshotStore = raft.NewInmemSnapshotStore()
+	_, s.Transport = raft.NewInmemTransport("")
+	for _, opt := range opts {
+		opt(s)
+	}
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	waitFor(t, 10*time.Second, "a leader", s.isLeader)
+	return s
+}
+
+func TestConditionalWrites(t *testing.T) {
+	s := openTestStore(t)
+	if err := s.Create("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	kv, err := s.Get("a", ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		write func() error
+		want  ConflictError
+	}{
+		{"create existing", func() error { return s.Create("a", []byte("2")) },
+			ConflictError{Op: "create", Key: "a", Reason: ConflictKeyExists, Exists: true, Current: []byte("1"), ModRevision: kv.ModRevision}},
+		{"update missing", func() error { return s.Update("b", []byte("2")) },
+			ConflictError{Op: "update", Key: "b", Reason: ConflictKeyNotFound}},
+		{"swap mismatch", func() error { return s.CompareAndSwap("a", []byte("0"), []byte("2")) },
+			ConflictError{Op: "cas", Key: "a", Reason: ConflictValueMismatch, Exists: true, Current: []byte("1"), ModRevision: kv.ModRevision}},
+		{"swap missing", func() error { return s.CompareAndSwap("b", []byte("1"), []byte("2")) },
+			ConflictError{Op: "cas", Key: "b", Reason: ConflictKeyNotFound}},
+	} {
+		err := tc.write()
+		conflict, ok := err.(*ConflictError)
+		if !ok {
+			t.Errorf("%s: got %v, want a *ConflictError", tc.name, err)
+			continue
+		}
+		if conflict.Op != tc.want.Op || conflict.Key != tc.want.Key || conflict.Reason != tc.want.Reason ||
+			conflict.Exists != tc.want.Exists || !bytes.Equal(conflict.Current, tc.want.Current) || conflict.ModRevision != tc.want.ModRevision {
+			t.Errorf("%s: got %+v, want %+v", tc.name, conflict, tc.want)
+		}
+	}
+
+	// Nothing was written by the failed writes.
+	if got, err := s.Get("a", ReadOptions{}); err != nil || string(got.Value) != "1" || got.ModRevision != kv.ModRevision {
+		t.Fatalf("a is %+v after failed writes, %v", got, err)
+	}
+	if got, err := s.Get("b", ReadOptions{}); err != nil || got != nil {
+		t.Fatalf("b is %+v after failed writes, %v", got, err)
+	}
+
+	// Writes whose condition holds go through.
+	if err := s.CompareAndSwap("a", []byte("1"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update("a", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Get("a", ReadOptions{}); err != nil || string(got.Value) != "3" || got.Version != 3 {
+		t.Fatalf("a is %+v, want value 3 at version 3: %v", got, err)
+	}
+}
+
+func TestConditionalWriteKeepsLease(t *testing.T) {
+	s := openTestStore(t)
+	l, err := s.Grant(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetWithLease("ephemeral", []byte("1"), l.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.CompareAndSwap("ephemeral", []byte("1"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update("ephemeral", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	kv, err := s.Get("ephemeral", ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv.Lease != l.ID {
+		t.Fatalf("lease of the key is %d, want %d", kv.Lease, l.ID)
+	}
+
+	if err := s.Revoke(l.ID); err != nil {
+		t.Fatal(err)
+	}
+	if kv, err := s.Get("ephemeral", ReadOptions{}); err != nil || kv != nil {
+		t.Fatalf("key outlived its lease: %v, %v", kv, err)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	s := openTestStore(t)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,470 @@
+// Package storetest runs clusters of store.Store nodes in a single process,
+// for tests. The nodes talk over raft.InmemTransport and keep their logs and
+// snapshots in memory, so a cluster needs no ports or directories, and the
+// links between nodes can be cut and healed.
+//
+// A typical test starts a cluster, writes through its leader and checks
+// what the other nodes see:
+//
+//	c := storetest.New(t, 3)
+//	if err := c.Leader().Store.Set("k", []byte("v")); err != nil {
+//		t.Fatal(err)
+//	}
+//	c.WaitConverged()
+package storetest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/raestrada/sappers/consensus/store"
+)
+
+// WaitTimeout bounds how long the helpers of a cluster wait for it to reach
+// the expected state before failing the test.
+var WaitTimeout = 10 * time.Second
+
+// pollInterval is how often the helpers check the state of the cluster.
+const pollInterval = 10 * time.Millisecond
+
+// Tuning is the Raft tuning of the nodes, before options are applied. Its
+// short timeouts make elections and failovers take milliseconds.
+var Tuning = func() store.RaftTuning {
+	t := store.DefaultRaftTuning()
+	t.HeartbeatTimeout = 50 * time.Millisecond
+	t.ElectionTimeout = 50 * time.Millisecond
+	t.LeaderLeaseTimeout = 50 * time.Millisecond
+	t.CommitTimeout = 5 * time.Millisecond
+	return t
+}()
+
+// Option configures the store of every node before it is opened, e.g. to
+// register ops or enable batching. It is applied again when a node restarts.
+type Option func(s *store.Store)
+
+// Node is a member of a test cluster. Its Raft log, stable store and
+// snapshots survive Stop, so Restart brings the node back with its state.
+type Node struct {
+	ID   string
+	Addr raft.ServerAddress
+
+	// Store is the running store of the node, nil while it is stopped.
+	Store *store.Store
+
+	transport *raft.InmemTransport
+	logs      *raft.InmemStore
+	stable    *raft.InmemStore
+	snapshots *raft.InmemSnapshotStore
+}
+
+// Running reports whether the node is started.
+func (n *Node) Running() bool {
+	return n.Store != nil
+}
+
+// Cluster is a set of nodes running in this process.
+type Cluster struct {
+	t    testing.TB
+	opts []Option
+
+	mu    sync.Mutex
+	nodes []*Node
+	cut   map[[2]string]bool // Cut links, by pair of node IDs.
+}
+
+// New starts a cluster of n nodes. The first node bootstraps the cluster and
+// the others join it, as voters unless the options set a voter target. The
+// cluster is closed when the test ends.
+func New(t testing.TB, n int, opts ...Option) *Cluster {
+	t.Helper()
+	if n < 1 {
+		t.Fatalf("storetest: a cluster needs at least one node, got %d", n)
+	}
+
+	c := &Cluster{
+		t:    t,
+		opts: opts,
+		cut:  make(map[[2]string]bool),
+	}
+	t.Cleanup(c.Close)
+
+	first := c.newNode()
+	c.start(first, true)
+	c.Leader()
+	for i := 1; i < n; i++ {
+		c.Add()
+	}
+	c.WaitConverged()
+	return c
+}
+
+// Nodes returns every node of the cluster, running or not, in the order
+// they were added.
+func (c *Cluster) Nodes() []*Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*Node(nil), c.nodes...)
+}
+
+// Node returns the i-th node of the cluster.
+func (c *Cluster) Node(i int) *Node {
+	return c.Nodes()[i]
+}
+
+// Add starts a new node and joins it to the cluster.
+func (c *Cluster) Add() *Node {
+	c.t.Helper()
+	n := c.newNode()
+	c.start(n, false)
+
+	leader := c.Leader()
+	if err := leader.Store.Join(n.ID, string(n.Addr), n.Store.LocalNodeMeta()); err != nil {
+		c.t.Fatalf("storetest: joining %s: %v", n.ID, err)
+	}
+	return n
+}
+
+// newNode adds a stopped node with empty state to the cluster.
+func (c *Cluster) newNode() *Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := fmt.Sprintf("node%d", len(c.nodes))
+	addr, transport := raft.NewInmemTransport(raft.ServerAddress(id))
+	n := &Node{
+		ID:        id,
+		Addr:      addr,
+		transport: transport,
+		logs:      raft.NewInmemStore(),
+		stable:    raft.NewInmemStore(),
+		snapshots: raft.NewInmemSnapshotStore(),
+	}
+	c.nodes = append(c.nodes, n)
+	return n
+}
+
+// start opens the store of a stopped node and connects it to the nodes it
+// has no cut link with. extra options apply after those of the cluster.
+func (c *Cluster) start(n *Node, bootstrap bool, extra ...Option) {
+	c.t.Helper()
+	s := store.New(true)
+	s.RaftBind = string(n.Addr)
+	s.HTTPAddr = n.ID
+	s.StatusOf = c.status
+	s.LiveMembers = c.liveMembers
+	s.Transport = n.transport
+	s.LogStore = n.logs
+	s.StableStore = n.stable
+	s.SnapshotStore = n.snapshots
+	s.Tuning = Tuning
+	for _, opt := range append(c.opts[:len(c.opts):len(c.opts)], extra...) {
+		opt(s)
+	}
+
+	c.mu.Lock()
+	n.Store = s
+	c.connectLocked(n)
+	c.mu.Unlock()
+
+	if err := s.Open(bootstrap, n.ID); err != nil {
+		c.t.Fatalf("storetest: opening %s: %v", n.ID, err)
+	}
+}
+
+// Stop closes the store of a node, as if its process exited.
+func (c *Cluster) Stop(n *Node) {
+	c.t.Helper()
+	c.mu.Lock()
+	s := n.Store
+	n.Store = nil
+	c.disconnectLocked(n)
+	c.mu.Unlock()
+
+	if s == nil {
+		return
+	}
+	if err := s.Close(); err != nil {
+		c.t.Fatalf("storetest: closing %s: %v", n.ID, err)
+	}
+}
+
+// Remove removes a node from the Raft configuration through the leader, and
+// stops it.
+func (c *Cluster) Remove(n *Node) {
+	c.t.Helper()
+	if err := c.Leader().Store.RemoveServer(n.ID); err != nil {
+		c.t.Fatalf("storetest: removing %s: %v", n.ID, err)
+	}
+	c.Stop(n)
+}
+
+// Restart starts a stopped node again, with the log and snapshots it had.
+func (c *Cluster) Restart(n *Node) {
+	c.t.Helper()
+	if n.Running() {
+		c.t.Fatalf("storetest: %s is running", n.ID)
+	}
+
+	// A fresh transport, so that no RPC queued for the stopped node is
+	// delivered to the new one.
+	_, n.transport = raft.NewInmemTransport(n.Addr)
+	c.start(n, false)
+}
+
+// Recover restarts the given stopped nodes in recovery mode, with a Raft
+// configuration of only them, as an operator would after the cluster lost
+// its quorum.
+func (c *Cluster) Recover(survivors ...*Node) {
+	c.t.Helper()
+	var peers []store.Server
+	for _, n := range survivors {
+		if n.Running() {
+			c.t.Fatalf("storetest: %s is running", n.ID)
+		}
+		peers = append(peers, store.Server{ID: n.ID, Address: string(n.Addr), Suffrage: "Voter"})
+	}
+	for _, n := range survivors {
+		_, n.transport = raft.NewInmemTransport(n.Addr)
+		c.start(n, false, func(s *store.Store) { s.RecoverPeers = peers })
+	}
+}
+
+// Partition cuts the links between the given nodes and the rest of the
+// cluster. The given nodes still reach each other.
+func (c *Cluster) Partition(nodes ...*Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	inside := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		inside[n.ID] = true
+	}
+	for _, a := range c.nodes {
+		for _, b := range c.nodes {
+			if inside[a.ID] && !inside[b.ID] {
+				c.cut[link(a, b)] = true
+			}
+		}
+	}
+	for _, n := range c.nodes {
+		c.disconnectLocked(n)
+		if n.Running() {
+			c.connectLocked(n)
+		}
+	}
+}
+
+// Cut cuts the link between two nodes.
+func (c *Cluster) Cut(a, b *Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cut[link(a, b)] = true
+	a.transport.Disconnect(b.Addr)
+	b.transport.Disconnect(a.Addr)
+}
+
+// Heal restores every cut link between running nodes.
+func (c *Cluster) Heal() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cut = make(map[[2]string]bool)
+	for _, n := range c.nodes {
+		if n.Running() {
+			c.connectLocked(n)
+		}
+	}
+}
+
+// link returns the key of the link between two nodes in Cluster.cut.
+func link(a, b *Node) [2]string {
+	if a.ID > b.ID {
+		a, b = b, a
+	}
+	return [2]string{a.ID, b.ID}
+}
+
+// connectLocked connects n both ways to every running node it has no cut
+// link with. The caller must hold c.mu.
+func (c *Cluster) connectLocked(n *Node) {
+	for _, peer := range c.nodes {
+		if peer == n || !peer.Running() || c.cut[link(n, peer)] {
+			continue
+		}
+		n.transport.Connect(peer.Addr, peer.transport)
+		peer.transport.Connect(n.Addr, n.transport)
+	}
+}
+
+// disconnectLocked disconnects n from every node. The caller must hold
+// c.mu.
+func (c *Cluster) disconnectLocked(n *Node) {
+	n.transport.DisconnectAll()
+	for _, peer := range c.nodes {
+		if peer != n {
+			peer.transport.Disconnect(n.Addr)
+		}
+	}
+}
+
+// status returns the status of the node whose API address, the node ID, is
+// addr.
+func (c *Cluster) status(addr string) (*store.Status, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, n := range c.nodes {
+		if n.ID == addr && n.Running() {
+			return n.Store.Status(), nil
+		}
+	}
+	return nil, fmt.Errorf("storetest: %s is not running", addr)
+}
+
+// liveMembers returns the IDs of the running nodes, as a gossip layer that
+// notices stopped nodes at once would.
+func (c *Cluster) liveMembers() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ids []string
+	for _, n := range c.nodes {
+		if n.Running() {
+			ids = append(ids, n.ID)
+		}
+	}
+	return ids
+}
+
+// Leader waits until a quorum of the voters follow a running node that
+// considers itself the leader, and returns that node. A leader cut off from
+// the majority is not returned, even before it steps down.
+func (c *Cluster) Leader() *Node {
+	c.t.Helper()
+	var leader *Node
+	c.WaitFor("a leader with a quorum", func() bool {
+		leader = c.leader()
+		return leader != nil
+	})
+	return leader
+}
+
+// NewLeader waits until a node other than old leads a quorum of the voters,
+// and returns it. Right after old is stopped or partitioned the other nodes
+// still follow it, so failover tests wait with NewLeader rather than Leader.
+func (c *Cluster) NewLeader(old *Node) *Node {
+	c.t.Helper()
+	var leader *Node
+	c.WaitFor(fmt.Sprintf("a leader other than %s", old.ID), func() bool {
+		leader = c.leader()
+		return leader != nil && leader != old
+	})
+	return leader
+}
+
+// leader returns the leader followed by a quorum of the voters, if any. The
+// voters are those of the configuration of the would-be leader, and a
+// quorum of them must name it as their leader.
+func (c *Cluster) leader() *Node {
+	c.mu.Lock()
+	running := make(map[string]*store.Store)
+	for _, n := range c.nodes {
+		if n.Running() {
+			running[n.ID] = n.Store
+		}
+	}
+	nodes := append([]*Node(nil), c.nodes...)
+	c.mu.Unlock()
+
+	for _, n := range nodes {
+		s := running[n.ID]
+		if s == nil || s.LeaderID() != n.ID {
+			continue
+		}
+		servers, err := s.Servers()
+		if err != nil {
+			continue
+		}
+		voters, follows := 0, 0
+		for _, srv := range servers {
+			if srv.Suffrage != "Voter" {
+				continue
+			}
+			voters++
+			if f := running[srv.ID]; f != nil && f.LeaderID() == n.ID {
+				follows++
+			}
+		}
+		if follows > voters/2 {
+			return n
+		}
+	}
+	return nil
+}
+
+// Followers returns the running nodes other than the leader.
+func (c *Cluster) Followers() []*Node {
+	c.t.Helper()
+	leader := c.Leader()
+	var followers []*Node
+	for _, n := range c.Nodes() {
+		if n.Running() && n != leader {
+			followers = append(followers, n)
+		}
+	}
+	return followers
+}
+
+// WaitConverged waits until every running node that reaches the leader has
+// applied every entry committed when it was called.
+func (c *Cluster) WaitConverged() {
+	c.t.Helper()
+
+	// A linearizable read returns once the leader applied every entry
+	// committed before it, including those of a previous term after a
+	// restart.
+	var leader *Node
+	c.WaitFor("the leader to apply its log", func() bool {
+		leader = c.Leader()
+		_, err := leader.Store.Get("", store.ReadOptions{Consistency: store.ReadLinearizable})
+		return err == nil
+	})
+	revision := leader.Store.Revision()
+
+	c.mu.Lock()
+	var nodes []*Node
+	for _, n := range c.nodes {
+		if n.Running() && !c.cut[link(n, leader)] {
+			nodes = append(nodes, n)
+		}
+	}
+	c.mu.Unlock()
+
+	c.WaitFor(fmt.Sprintf("every node to apply revision %d", revision), func() bool {
+		for _, n := range nodes {
+			if n.Store.Revision() < revision {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// WaitFor waits until cond holds, failing the test after WaitTimeout.
+func (c *Cluster) WaitFor(what string, cond func() bool) {
+	c.t.Helper()
+	deadline := time.Now().Add(WaitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("storetest: timed out waiting for %s", what)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// Close stops every running node.
+func (c *Cluster) Close() {
+	for _, n := range c.Nodes() {
+		if n.Running() {
+			c.Stop(n)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package storetest
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/raestrada/sappers/consensus/store"
+)
+
+// get reads key from the local state of n.
+func get(t *testing.T, n *Node, key string) string {
+	t.Helper()
+	kv, err := n.Store.Get(key, store.ReadOptions{})
+	if err != nil {
+		t.Fatalf("get %q from %s: %v", key, n.ID, err)
+	}
+	if kv == nil {
+		return ""
+	}
+	return string(kv.Value)
+}
+
+// checkKeys fails the test unless every running node holds the n keys
+// written by setKeys.
+func checkKeys(t *testing.T, c *Cluster, prefix string, n int) {
+	t.Helper()
+	for _, node := range c.Nodes() {
+		if !node.Running() {
+			continue
+		}
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("%s/%d", prefix, i)
+			if got, want := get(t, node, key), fmt.Sprint(i); got != want {
+				t.Fatalf("%s: %q = %q, want %q", node.ID, key, got, want)
+			}
+		}
+	}
+}
+
+func setKeys(t *testing.T, s *store.Store, prefix string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := s.Set(fmt.Sprintf("%s/%d", prefix, i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("set %s/%d: %v", prefix, i, err)
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	c := New(t, 3)
+	leader := c.Leader()
+	if leader != c.Node(0) {
+		t.Fatalf("leader is %s, want the bootstrap node", leader.ID)
+	}
+	setKeys(t, leader.Store, "before", 10)
+	c.WaitConverged()
+	checkKeys(t, c, "before", 10)
+
+	// A node joining later receives what was written before it.
+	n := c.Add()
+	setKeys(t, c.Leader().Store, "after", 10)
+	c.WaitConverged()
+	checkKeys(t, c, "before", 10)
+	checkKeys(t, c, "after", 10)
+
+	// Followers know every node, so they can forward to any leader.
+	for _, f := range c.Followers() {
+		if got := f.Store.LeaderID(); got != leader.ID {
+			t.Fatalf("%s follows %q, want %q", f.ID, got, leader.ID)
+		}
+	}
+	if err := n.Store.Set("k", []byte("v")); err == nil {
+		t.Fatal("write accepted by a follower")
+	}
+}
+
+func TestLeaderFailover(t *testing.T) {
+	c := New(t, 3)
+	old := c.Leader()
+	setKeys(t, old.Store, "a", 10)
+	c.WaitConverged()
+
+	c.Stop(old)
+	leader := c.NewLeader(old)
+	setKeys(t, leader.Store, "b", 10)
+
+	c.Restart(old)
+	c.WaitConverged()
+	checkKeys(t, c, "a", 10)
+	checkKeys(t, c, "b", 10)
+	if c.Leader() != leader {
+		t.Fatal("restarted node took over the leadership")
+	}
+}
+
+func TestPartitionedLeader(t *testing.T) {
+	c := New(t, 3)
+	old := c.Leader()
+
+	// The old leader is alone in the minority. The majority elects another
+	// leader, and the old one steps down and refuses writes.
+	c.Partition(old)
+	leader := c.NewLeader(old)
+	c.WaitFor("the old leader to step down", func() bool {
+		return old.Store.LeaderID() != old.ID
+	})
+	if err := old.Store.Set("minority", []byte("lost")); err == nil {
+		t.Fatal("write accepted by the minority")
+	}
+	setKeys(t, leader.Store, "majority", 10)
+
+	c.Heal()
+	c.WaitConverged()
+	checkKeys(t, c, "majority", 10)
+	if got := get(t, old, "minority"); got != "" {
+		t.Fatalf("write made in the minority survived: %q", got)
+	}
+}
+
+func TestReadConsistency(t *testing.T) {
+	c := New(t, 3)
+	leader := c.Leader()
+	setKeys(t, leader.Store, "k", 1)
+	c.WaitConverged()
+	follower := c.Followers()[0]
+
+	read := func(n *Node, opts store.ReadOptions) (string, error) {
+		kv, err := n.Store.Get("k/0", opts)
+		if err != nil || kv == nil {
+			return "", err
+		}
+		return string(kv.Value), nil
+	}
+
+	// A follower in touch with the leader serves stale reads.
+	stale := store.ReadOptions{Consistency: store.ReadStale, MaxLag: time.Minute}
+	if got, err := read(follower, stale); err != nil || got != "0" {
+		t.Fatalf("stale read on a follower: %q, %v", got, err)
+	}
+	// Only the leader serves linearizable reads, and names itself to the
+	// others.
+	linearizable := store.ReadOptions{Consistency: store.ReadLinearizable}
+	_, err := read(follower, linearizable)
+	var nle *store.NotLeaderError
+	if !errors.As(err, &nle) || nle.LeaderID != leader.ID {
+		t.Fatalf("linearizable read on a follower: %v, want a not-leader error naming %s", err, leader.ID)
+	}
+	if got, err := read(leader, linearizable); err != nil || got != "0" {
+		t.Fatalf("linearizable read on the leader: %q, %v", got, err)
+	}
+
+	// Cut off from the leader, the follower refuses reads past the lag
+	// bound, and still serves reads with no checks.
+	c.Partition(follower)
+	time.Sleep(100 * time.Millisecond)
+	bounded := store.ReadOptions{Consistency: store.ReadStale, MaxLag: 50 * time.Millisecond}
+	if _, err := read(follower, bounded); err != store.ErrStaleRead {
+		t.Fatalf("read past the max lag: %v, want ErrStaleRead", err)
+	}
+	if got, err := read(follower, store.ReadOptions{}); err != nil || got != "0" {
+		t.Fatalf("default read on a partitioned follower: %q, %v", got, err)
+	}
+}
+
+func TestWriteDurability(t *testing.T) {
+	c := New(t, 3, func(s *store.Store) { s.BatchMaxSize = 16 })
+	setKeys(t, c.Leader().Store, "k", 50)
+
+	// Every acknowledged write is on a majority, so it survives losing any
+	// one node, including the leader, before the others applied it.
+	old := c.Leader()
+	c.Stop(old)
+	leader := c.NewLeader(old)
+	for i := 0; i < 50; i++ {
+		kv, err := leader.Store.Get(fmt.Sprintf("k/%d", i), store.ReadOptions{Consistency: store.ReadLinearizable})
+		if err != nil || kv == nil || string(kv.Value) != fmt.Sprint(i) {
+			t.Fatalf("k/%d on the new leader: %v %v", i, kv, err)
+		}
+	}
+
+	// And the whole cluster restarting from its logs.
+	for _, n := range c.Nodes() {
+		c.Stop(n)
+	}
+	for _, n := range c.Nodes() {
+		c.Restart(n)
+	}
+	c.WaitConverged()
+	checkKeys(t, c, "k", 50)
+}
+
+// suffrages returns the suffrage of every server, by ID, as the leader sees
+// it.
+func suffrages(t *testing.T, c *Cluster) map[string]string {
+	t.Helper()
+	servers, err := c.Leader().Store.Servers()
+	if err != nil {
+		t.Fatalf("servers: %v", err)
+	}
+	m := make(map[string]string)
+	for _, srv := range servers {
+		m[srv.ID] = srv.Suffrage
+	}
+	return m
+}
+
+func TestVoterTarget(t *testing.T) {
+	c := New(t, 1, func(s *store.Store) {
+		s.VoterTarget = 3
+		s.ServerStabilization = 200 * time.Millisecond
+	})
+	n := c.Add()
+	if got := suffrages(t, c)[n.ID]; got != "Nonvoter" {
+		t.Fatalf("%s joined as %s, want Nonvoter", n.ID, got)
+	}
+	c.Add()
+	c.Add()
+
+	// The leader promotes non-voters up to the target.
+	countVoters := func() int {
+		voters := 0
+		for _, s := range suffrages(t, c) {
+			if s == "Voter" {
+				voters++
+			}
+		}
+		return voters
+	}
+	c.WaitFor("3 voters", func() bool { return countVoters() == 3 })
+	time.Sleep(500 * time.Millisecond)
+	if got := countVoters(); got != 3 {
+		t.Fatalf("%d voters, want the target of 3", got)
+	}
+
+	// A failed voter is demoted and the remaining non-voter takes its place.
+	var failed *Node
+	for _, f := range c.Followers() {
+		if suffrages(t, c)[f.ID] == "Voter" {
+			failed = f
+			break
+		}
+	}
+	c.Stop(failed)
+	c.WaitFor("the failed voter to be replaced", func() bool {
+		return suffrages(t, c)[failed.ID] == "Nonvoter" && countVoters() == 3
+	})
+
+	// Once back, it stays a non-voter: the cluster has its voters.
+	c.Restart(failed)
+	c.WaitConverged()
+	time.Sleep(500 * time.Millisecond)
+	if got := suffrages(t, c)[failed.ID]; got != "Nonvoter" {
+		t.Fatalf("restarted node is a %s, want Nonvoter", got)
+	}
+}
+
+func TestTransferLeadership(t *testing.T) {
+	c := New(t, 3)
+	old := c.Leader()
+
+	// Without a target the leadership goes to the most up-to-date voter.
+	if err := old.Store.TransferLeadership(""); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	leader := c.NewLeader(old)
+
+	// With one, to that voter.
+	if err := leader.Store.TransferLeadership(old.ID); err != nil {
+		t.Fatalf("transfer to %s: %v", old.ID, err)
+	}
+	if got := c.NewLeader(leader); got != old {
+		t.Fatalf("leader is %s, want %s", got.ID, old.ID)
+	}
+
+	if err := old.Store.TransferLeadership("nope"); err != store.ErrServerNotFound {
+		t.Fatalf("transfer to an unknown server: %v", err)
+	}
+	if err := c.Followers()[0].Store.TransferLeadership(""); err == nil {
+		t.Fatal("transfer accepted by a follower")
+	}
+}
+
+func TestRemoveAndDemote(t *testing.T) {
+	c := New(t, 3)
+	leader := c.Leader()
+	followers := c.Followers()
+
+	// A demoted voter still receives the log.
+	if err := leader.Store.DemoteVoter(followers[0].ID); err != nil {
+		t.Fatalf("demote: %v", err)
+	}
+	if got := suffrages(t, c)[followers[0].ID]; got != "Nonvoter" {
+		t.Fatalf("demoted node is a %s", got)
+	}
+	setKeys(t, leader.Store, "k", 10)
+	c.WaitConverged()
+	checkKeys(t, c, "k", 10)
+
+	// A removed node no longer counts toward the quorum: the leader, now
+	// the only voter, commits on its own.
+	c.Remove(followers[1])
+	if _, ok := suffrages(t, c)[followers[1].ID]; ok {
+		t.Fatalf("%s still in the configuration", followers[1].ID)
+	}
+	if err := leader.Store.Set("after", []byte("removal")); err != nil {
+		t.Fatalf("write after removal: %v", err)
+	}
+	if err := leader.Store.RemoveServer(followers[1].ID); err != store.ErrServerNotFound {
+		t.Fatalf("removing twice: %v", err)
+	}
+
+	// The last voter can be neither removed nor demoted.
+	if err := leader.Store.RemoveServer(leader.ID); err != store.ErrLastVoter {
+		t.Fatalf("removing the last voter: %v", err)
+	}
+	if err := leader.Store.DemoteVoter(leader.ID); err != store.ErrLastVoter {
+		t.Fatalf("demoting the last voter: %v", err)
+	}
+}
+
+func TestDeadServerCleanup(t *testing.T) {
+	c := New(t, 5, func(s *store.Store) {
+		s.DeadServerGrace = 200 * time.Millisecond
+		s.MinQuorum = 3
+	})
+
+	// Dead servers are removed while at least MinQuorum voters are left.
+	var stopped []*Node
+	for i, f := range c.Followers()[:3] {
+		c.Stop(f)
+		stopped = append(stopped, f)
+		if want := 5 - i - 1; want >= 3 {
+			c.WaitFor(fmt.Sprintf("%s to be removed", f.ID), func() bool {
+				return len(suffrages(t, c)) == want
+			})
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+	servers := suffrages(t, c)
+	if len(servers) != 3 {
+		t.Fatalf("%d servers left, want MinQuorum = 3", len(servers))
+	}
+	setKeys(t, c.Leader().Store, "k", 10)
+
+	// The leader reports the remaining dead server, and how far behind the
+	// live follower is.
+	leader := c.Leader()
+	for _, h := range leader.Store.Health() {
+		node := servers[h.ID] != ""
+		if !node {
+			t.Fatalf("health of removed server %s", h.ID)
+		}
+		dead := false
+		for _, n := range stopped {
+			dead = dead || n.ID == h.ID
+		}
+		if dead != (h.DeadSince != nil) || dead == h.Healthy {
+			t.Fatalf("health of %s: %+v", h.ID, h)
+		}
+	}
+	if len(c.Followers()) != 1 {
+		t.Fatalf("%d running followers, want 1", len(c.Followers()))
+	}
+	follower := c.Followers()[0]
+	c.WaitFor("the lag of the follower", func() bool {
+		for _, h := range leader.Store.Health() {
+			if h.ID == follower.ID && h.Lag != nil && h.LastContact != nil {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestRecover(t *testing.T) {
+	c := New(t, 3)
+	setKeys(t, c.Leader().Store, "k", 10)
+	c.WaitConverged()
+
+	// With two of three voters lost for good, the survivor cannot elect
+	// itself until it is recovered with a configuration of its own.
+	survivor := c.Followers()[0]
+	for _, n := range c.Nodes() {
+		c.Stop(n)
+	}
+	c.Recover(survivor)
+	if got := c.Leader(); got != survivor {
+		t.Fatalf("leader is %s, want %s", got.ID, survivor.ID)
+	}
+	checkKeys(t, c, "k", 10)
+	if err := survivor.Store.Set("after", []byte("recovery")); err != nil {
+		t.Fatalf("write after recovery: %v", err)
+	}
+
+	// A restart with the same recovery peers does not drop the servers
+	// that joined since.
+	added := c.Add()
+	c.WaitConverged()
+	c.Stop(survivor)
+	c.Recover(survivor)
+	c.Leader()
+	servers, err := survivor.Store.Servers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 2 {
+		t.Fatalf("servers after a second recovery are %+v, want %s and %s", servers, survivor.ID, added.ID)
+	}
+	checkKeys(t, c, "k", 10)
+}
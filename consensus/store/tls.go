@@ -0,0 +1,425 @@
+package store
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+// ErrInvalidTLS is returned when the TLS configuration of the Raft transport
+// is incomplete or its files cannot be loaded.
+var ErrInvalidTLS = errors.New("invalid raft TLS configuration")
+
+// TLSConfig secures the Raft transport with mutual TLS. Every node presents
+// its certificate, signed by the CA, on the connections it opens and on the
+// ones it accepts, so the certificates must allow both server and client
+// authentication.
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM certificate and key of this node.
+	CertFile string
+	KeyFile  string
+
+	// CAFile holds the PEM certificates of the CAs that sign the
+	// certificates of the nodes. No other certificate is trusted.
+	CAFile string
+
+	// VerifyServerID requires the certificate of a peer to name its server
+	// ID, as its common name or one of its DNS names. A node dialing a
+	// server checks the certificate against the ID the Raft configuration
+	// gives that address, and a node accepting a connection checks it
+	// against the IDs of its configuration, unless it has none yet because
+	// it is joining. Every RPC it then receives over that connection must
+	// come from the server the certificate names. Without it, any
+	// certificate the CA signed will do.
+	VerifyServerID bool
+}
+
+// Validate reports whether the configuration names every file it needs.
+func (c *TLSConfig) Validate() error {
+	if c.CertFile == "" || c.KeyFile == "" || c.CAFile == "" {
+		return fmt.Errorf("%w: the certificate, key and CA files are all required", ErrInvalidTLS)
+	}
+	return nil
+}
+
+// load reads the certificate of this node and the CA pool.
+func (c *TLSConfig) load() (tls.Certificate, *x509.CertPool, error) {
+	if err := c.Validate(); err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("%w: %v", ErrInvalidTLS, err)
+	}
+	pem, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("%w: %v", ErrInvalidTLS, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return tls.Certificate{}, nil, fmt.Errorf("%w: no certificate found in %s", ErrInvalidTLS, c.CAFile)
+	}
+	return cert, pool, nil
+}
+
+// tlsStreamLayer is a raft.StreamLayer that runs every connection over
+// mutual TLS.
+type tlsStreamLayer struct {
+	net.Listener
+	advertise net.Addr
+
+	cert tls.Certificate
+	pool *x509.CertPool
+
+	// verifyID checks the identity of peers against the configuration of
+	// raft, set once Raft is started.
+	verifyID bool
+	raft     atomic.Pointer[raft.Raft]
+}
+
+// newTLSStreamLayer listens on bind for the TLS connections of the peers.
+func newTLSStreamLayer(bind string, c *TLSConfig) (*tlsStreamLayer, error) {
+	cert, pool, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, err
+	}
+	advertise := ln.Addr().(*net.TCPAddr)
+	if advertise.IP == nil || advertise.IP.IsUnspecified() {
+		ln.Close()
+		return nil, fmt.Errorf("raft address %s is not advertisable", bind)
+	}
+
+	l := &tlsStreamLayer{
+		advertise: advertise,
+		cert:      cert,
+		pool:      pool,
+		verifyID:  c.VerifyServerID,
+	}
+	l.Listener = tls.NewListener(ln, &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		Certificates:     []tls.Certificate{cert},
+		ClientAuth:       tls.RequireAndVerifyClientCert,
+		ClientCAs:        pool,
+		VerifyConnection: l.verifyClient,
+	})
+	return l, nil
+}
+
+// servers returns the servers of the latest Raft configuration, none before
+// Raft is started.
+func (l *tlsStreamLayer) servers() []raft.Server {
+	r := l.raft.Load()
+	if r == nil {
+		return nil
+	}
+	return r.GetConfiguration().Configuration().Servers
+}
+
+// Addr returns the address other nodes reach this one at.
+func (l *tlsStreamLayer) Addr() net.Addr {
+	return l.advertise
+}
+
+// Dial opens a TLS connection to the server at address and verifies its
+// certificate.
+func (l *tlsStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: timeout},
+		Config: &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{l.cert},
+			// The chain and the identity are verified by verifyServer, since
+			// peers are known by server ID rather than by host name.
+			InsecureSkipVerify: true,
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				return l.verifyServer(address, cs)
+			},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return dialer.DialContext(ctx, "tcp", string(address))
+}
+
+// verifyServer checks that the server at address presents a certificate
+// signed by the CA that names the ID the Raft configuration gives address.
+func (l *tlsStreamLayer) verifyServer(address raft.ServerAddress, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("raft peer presented no certificate")
+	}
+	cert := cs.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         l.pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}); err != nil {
+		return err
+	}
+	if !l.verifyID {
+		return nil
+	}
+
+	for _, srv := range l.servers() {
+		if srv.Address == address {
+			if !certNamesID(cert, srv.ID) {
+				return fmt.Errorf("certificate of raft peer %s does not name server %s", address, srv.ID)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("raft peer %s is not in the configuration", address)
+}
+
+// verifyClient checks that a peer connecting to this node presents a
+// certificate that names a server of the Raft configuration. Its chain was
+// already verified against the CA. Which server the peer speaks for is
+// checked on each RPC, by tlsTransport.
+func (l *tlsStreamLayer) verifyClient(cs tls.ConnectionState) error {
+	if !l.verifyID {
+		return nil
+	}
+	servers := l.servers()
+	// A node that is joining has no configuration until the leader sends it
+	// one, over this very connection.
+	if len(servers) == 0 {
+		return nil
+	}
+	cert := cs.PeerCertificates[0]
+	for _, srv := range servers {
+		if certNamesID(cert, srv.ID) {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate of raft peer %q names no server of the configuration", cert.Subject.CommonName)
+}
+
+// certNamesID reports whether cert names the server id.
+func certNamesID(cert *x509.Certificate, id raft.ServerID) bool {
+	if cert.Subject.CommonName == string(id) {
+		return true
+	}
+	for _, name := range cert.DNSNames {
+		if name == string(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsTransport is the Raft transport over a tlsStreamLayer that verifies
+// server IDs. It sends RPCs through a NetworkTransport, and serves each
+// accepted connection with a NetworkTransport of its own, so that it knows
+// the certificate every RPC came with: an RPC whose header names a server
+// the certificate does not is refused, and its connection closed.
+type tlsTransport struct {
+	*raft.NetworkTransport
+
+	layer     *tlsStreamLayer
+	timeout   time.Duration
+	consumer  chan raft.RPC
+	heartbeat atomic.Pointer[func(raft.RPC)]
+
+	shutdownCh chan struct{}
+	closeOnce  sync.Once
+}
+
+// newTLSTransport returns the Raft transport over l, with the pool size and
+// I/O timeout of raft.NewNetworkTransport.
+func newTLSTransport(l *tlsStreamLayer, maxPool int, timeout time.Duration) raft.Transport {
+	if !l.verifyID {
+		return raft.NewNetworkTransport(l, maxPool, timeout, os.Stderr)
+	}
+	t := &tlsTransport{
+		layer:      l,
+		timeout:    timeout,
+		consumer:   make(chan raft.RPC),
+		shutdownCh: make(chan struct{}),
+	}
+	t.NetworkTransport = raft.NewNetworkTransport(&dialLayer{tlsStreamLayer: l, closed: t.shutdownCh}, maxPool, timeout, os.Stderr)
+	go t.accept()
+	return t
+}
+
+// Consumer returns the RPCs of every accepted connection that passed the
+// check of their header.
+func (t *tlsTransport) Consumer() <-chan raft.RPC {
+	return t.consumer
+}
+
+// SetHeartbeatHandler sets the handler of heartbeats, which are checked as
+// any other RPC first.
+func (t *tlsTransport) SetHeartbeatHandler(cb func(rpc raft.RPC)) {
+	t.heartbeat.Store(&cb)
+}
+
+// Close stops sending and accepting RPCs.
+func (t *tlsTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.shutdownCh) })
+	return t.NetworkTransport.Close()
+}
+
+// accept serves the connections of the peers until the transport is closed.
+func (t *tlsTransport) accept() {
+	for {
+		conn, err := t.layer.Accept()
+		if err != nil {
+			select {
+			case <-t.shutdownCh:
+				return
+			case <-time.After(10 * time.Millisecond):
+				continue
+			}
+		}
+		go t.serve(conn.(*tls.Conn))
+	}
+}
+
+// serve passes on the RPCs of a connection as long as they come from the
+// server its certificate names.
+func (t *tlsTransport) serve(conn *tls.Conn) {
+	funcDesc := "store - tlsTransport"
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	err := conn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	cert := conn.ConnectionState().PeerCertificates[0]
+
+	l := &connLayer{addr: t.layer.Addr(), accepted: make(chan net.Conn, 1), closed: make(chan struct{})}
+	n := raft.NewNetworkTransport(l, 1, t.timeout, os.Stderr)
+	// The connection is closed by n once its peer is gone, or by refuse.
+	l.accepted <- &closeConn{Conn: conn, onClose: func() { n.Close() }}
+	defer n.Close()
+
+	refuse := func(rpc raft.RPC, err error) {
+		zap.L().Warn(funcDesc, zap.String("type", "refused raft RPC"), zap.Error(err))
+		rpc.Respond(nil, err)
+		conn.Close()
+	}
+	n.SetHeartbeatHandler(func(rpc raft.RPC) {
+		if err := checkRPCHeader(cert, rpc); err != nil {
+			refuse(rpc, err)
+		} else if cb := t.heartbeat.Load(); cb != nil {
+			(*cb)(rpc)
+		} else {
+			t.forward(rpc)
+		}
+	})
+
+	for {
+		select {
+		case rpc := <-n.Consumer():
+			if err := checkRPCHeader(cert, rpc); err != nil {
+				refuse(rpc, err)
+				continue
+			}
+			t.forward(rpc)
+		case <-l.closed:
+			return
+		case <-t.shutdownCh:
+			return
+		}
+	}
+}
+
+// forward hands an RPC to Raft, or refuses it if the transport is closed.
+func (t *tlsTransport) forward(rpc raft.RPC) {
+	select {
+	case t.consumer <- rpc:
+	case <-t.shutdownCh:
+		rpc.Respond(nil, raft.ErrTransportShutdown)
+	}
+}
+
+// checkRPCHeader checks that an RPC comes from the server cert names.
+func checkRPCHeader(cert *x509.Certificate, rpc raft.RPC) error {
+	h, ok := rpc.Command.(raft.WithRPCHeader)
+	if !ok {
+		return fmt.Errorf("raft RPC %T has no header", rpc.Command)
+	}
+	if id := raft.ServerID(h.GetRPCHeader().ID); !certNamesID(cert, id) {
+		return fmt.Errorf("raft peer %q sent an RPC as server %q", cert.Subject.CommonName, id)
+	}
+	return nil
+}
+
+// dialLayer is the stream layer tlsTransport sends RPCs through. It accepts
+// nothing, since tlsTransport accepts the connections itself.
+type dialLayer struct {
+	*tlsStreamLayer
+	closed chan struct{}
+}
+
+// Accept blocks until the transport is closed.
+func (l *dialLayer) Accept() (net.Conn, error) {
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+// connLayer is the stream layer of a single accepted connection.
+type connLayer struct {
+	addr      net.Addr
+	accepted  chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Accept returns the connection once, and then blocks until l is closed.
+func (l *connLayer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close makes Accept return.
+func (l *connLayer) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+// Addr returns the address of this node.
+func (l *connLayer) Addr() net.Addr {
+	return l.addr
+}
+
+// Dial fails: RPCs are sent by tlsTransport.
+func (l *connLayer) Dial(raft.ServerAddress, time.Duration) (net.Conn, error) {
+	return nil, errors.New("a raft connection layer does not dial")
+}
+
+// closeConn is a connection that calls onClose once it is closed.
+type closeConn struct {
+	net.Conn
+	onClose func()
+}
+
+// Close closes the connection and calls onClose.
+func (c *closeConn) Close() error {
+	err := c.Conn.Close()
+	c.onClose()
+	return err
+}
@@ -0,0 +1,258 @@
+package store
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// testCA signs the certificates of the nodes of a test.
+type testCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+// newTestCA creates a self-signed CA in a temporary directory.
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{dir: t.TempDir(), cert: cert, key: key}
+	ca.file = ca.write(t, "ca.pem", "CERTIFICATE", der)
+	return ca
+}
+
+// write saves a PEM block in the directory of the CA and returns its path.
+func (ca *testCA) write(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(ca.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// issue signs a certificate naming id for both server and client
+// authentication, and returns the TLS configuration of a node using it.
+func (ca *testCA) issue(t *testing.T, id string) *TLSConfig {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: id},
+		DNSNames:     []string{id},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &TLSConfig{
+		CertFile:       ca.write(t, id+".pem", "CERTIFICATE", der),
+		KeyFile:        ca.write(t, id+"-key.pem", "EC PRIVATE KEY", keyDER),
+		CAFile:         ca.file,
+		VerifyServerID: true,
+	}
+}
+
+// freeAddr returns a local address with a free port.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// openTLSStore opens a store whose Raft transport runs over TLS, and returns
+// it with its Raft address.
+func openTLSStore(t *testing.T, id string, bootstrap bool, c *TLSConfig, opts ...func(*Store)) (*Store, string) {
+	t.Helper()
+	s := New(false)
+	s.RaftBind = freeAddr(t)
+	s.TLS = c
+	s.LogStore, s.StableStore = raft.NewInmemStore(), raft.NewInmemStore()
+	s.SnapshotStore = raft.NewInmemSnapshotStore()
+	for _, opt := range opts {
+		opt(s)
+	}
+	if err := s.Open(bootstrap, id); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, s.RaftBind
+}
+
+// waitFor polls cond until it holds or the timeout expires.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestTLSTransport(t *testing.T) {
+	ca := newTestCA(t)
+	leader, _ := openTLSStore(t, "node0", true, ca.issue(t, "node0"))
+	waitFor(t, 10*time.Second, "a leader", leader.isLeader)
+
+	follower, addr := openTLSStore(t, "node1", false, ca.issue(t, "node1"))
+	if err := leader.Join("node1", addr, NodeMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Set("secret", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 10*time.Second, "the write to replicate", func() bool {
+		kv, err := follower.Get("secret", ReadOptions{})
+		return err == nil && kv != nil && string(kv.Value) == "value"
+	})
+}
+
+func TestTLSTransportVerifiesPeers(t *testing.T) {
+	ca := newTestCA(t)
+	// The peers join as non-voters, so that the leader commits alone
+	// whether it reaches them or not.
+	leader, leaderAddr := openTLSStore(t, "node0", true, ca.issue(t, "node0"), func(s *Store) { s.VoterTarget = 1 })
+	waitFor(t, 10*time.Second, "a leader", leader.isLeader)
+
+	_, addr := openTLSStore(t, "node1", false, ca.issue(t, "node1"))
+	if err := leader.Join("node1", addr, NodeMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	// An impostor runs as node2 with the certificate of another node.
+	_, impostorAddr := openTLSStore(t, "node2", false, ca.issue(t, "mallory"))
+	if err := leader.Join("node2", impostorAddr, NodeMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	// A node that never joined is out of the configuration.
+	_, strangerAddr := openTLSStore(t, "node3", false, ca.issue(t, "node3"))
+
+	// dial connects to a server as a node sharing the configuration of the
+	// leader.
+	dial := func(c *TLSConfig, addr string) error {
+		stream, err := newTLSStreamLayer(freeAddr(t), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stream.Close()
+		stream.raft.Store(leader.raft)
+		conn, err := stream.Dial(raft.ServerAddress(addr), time.Second)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// The server verifies the certificate of the client while the client
+		// may already consider the handshake done, so its verdict only shows
+		// on the first read.
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, err := conn.Read(make([]byte, 1)); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
+		}
+		return nil
+	}
+
+	if err := dial(ca.issue(t, "node1"), addr); err != nil {
+		t.Fatalf("dial node1: %v", err)
+	}
+	if err := dial(ca.issue(t, "node1"), impostorAddr); err == nil {
+		t.Fatal("dialed an impostor of node2")
+	}
+	if err := dial(ca.issue(t, "node1"), strangerAddr); err == nil {
+		t.Fatal("dialed a server out of the configuration")
+	}
+	if err := dial(ca.issue(t, "mallory"), leaderAddr); err == nil {
+		t.Fatal("leader accepted a client out of the configuration")
+	}
+	if err := dial(newTestCA(t).issue(t, "node1"), leaderAddr); err == nil {
+		t.Fatal("connected with a certificate of another CA")
+	}
+}
+
+func TestTLSTransportChecksRPCSender(t *testing.T) {
+	ca := newTestCA(t)
+	leader, leaderAddr := openTLSStore(t, "node0", true, ca.issue(t, "node0"), func(s *Store) { s.VoterTarget = 1 })
+	waitFor(t, 10*time.Second, "a leader", leader.isLeader)
+	_, addr := openTLSStore(t, "node1", false, ca.issue(t, "node1"))
+	if err := leader.Join("node1", addr, NodeMeta{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A peer holding the certificate of node1 asks for votes, harmlessly at
+	// term 0, as node1 and as another server.
+	stream, err := newTLSStreamLayer(freeAddr(t), ca.issue(t, "node1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.raft.Store(leader.raft)
+	trans := raft.NewNetworkTransport(stream, 1, time.Second, os.Stderr)
+	defer trans.Close()
+	requestVote := func(id string) error {
+		req := &raft.RequestVoteRequest{RPCHeader: raft.RPCHeader{
+			ProtocolVersion: raft.ProtocolVersionMax,
+			ID:              []byte(id),
+			Addr:            []byte(addr),
+		}}
+		return trans.RequestVote("node0", raft.ServerAddress(leaderAddr), req, &raft.RequestVoteResponse{})
+	}
+
+	if err := requestVote("node1"); err != nil {
+		t.Fatalf("RPC as the server of the certificate: %v", err)
+	}
+	if err := requestVote("node0"); err == nil {
+		t.Fatal("leader accepted an RPC as a server the certificate does not name")
+	}
+	// The refused connection is closed, and a new one is served.
+	if err := requestVote("node1"); err != nil {
+		t.Fatalf("RPC after a refused one: %v", err)
+	}
+}
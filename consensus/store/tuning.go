@@ -0,0 +1,184 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// ErrInvalidTuning is returned when Raft tuning parameters are out of range
+// or inconsistent with each other.
+var ErrInvalidTuning = errors.New("invalid raft tuning")
+
+// RaftTuning holds the Raft timings and limits of a store. A new store runs
+// with DefaultRaftTuning, and fields are used as set, zero included.
+type RaftTuning struct {
+	// HeartbeatTimeout is how long a follower waits without contact from
+	// the leader before it starts an election.
+	HeartbeatTimeout time.Duration
+
+	// ElectionTimeout is how long a candidate waits for votes before it
+	// starts a new election.
+	ElectionTimeout time.Duration
+
+	// LeaderLeaseTimeout is how long a leader stays leader without contact
+	// from a quorum.
+	LeaderLeaseTimeout time.Duration
+
+	// CommitTimeout is the longest the leader waits before it sends
+	// entries to its followers, or a heartbeat if there are none.
+	CommitTimeout time.Duration
+
+	// SnapshotInterval is how often Raft checks whether to take a snapshot,
+	// and SnapshotThreshold how many log entries since the last snapshot
+	// make it take one.
+	SnapshotInterval  time.Duration
+	SnapshotThreshold uint64
+
+	// TrailingLogs is the number of log entries kept after a snapshot, so
+	// that slow followers catch up from the log rather than a snapshot.
+	TrailingLogs uint64
+
+	// RetainSnapshots is the number of snapshots kept in the Raft
+	// directory.
+	RetainSnapshots int
+
+	// ApplyTimeout bounds how long a write waits to be appended, and a
+	// linearizable read waits for the barrier.
+	ApplyTimeout time.Duration
+}
+
+// DefaultRaftTuning returns the tuning of a store with nothing configured.
+func DefaultRaftTuning() RaftTuning {
+	c := raft.DefaultConfig()
+	return RaftTuning{
+		HeartbeatTimeout:   c.HeartbeatTimeout,
+		ElectionTimeout:    c.ElectionTimeout,
+		LeaderLeaseTimeout: c.LeaderLeaseTimeout,
+		CommitTimeout:      c.CommitTimeout,
+		SnapshotInterval:   c.SnapshotInterval,
+		SnapshotThreshold:  c.SnapshotThreshold,
+		TrailingLogs:       c.TrailingLogs,
+		RetainSnapshots:    retainSnapshotCount,
+		ApplyTimeout:       raftTimeout,
+	}
+}
+
+// Validate returns an error wrapping ErrInvalidTuning if t cannot run Raft.
+func (t RaftTuning) Validate() error {
+	for _, f := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"heartbeat timeout", t.HeartbeatTimeout},
+		{"election timeout", t.ElectionTimeout},
+		{"leader lease timeout", t.LeaderLeaseTimeout},
+		{"commit timeout", t.CommitTimeout},
+		{"snapshot interval", t.SnapshotInterval},
+		{"apply timeout", t.ApplyTimeout},
+	} {
+		if f.d < 0 {
+			return fmt.Errorf("%w: negative %s %s", ErrInvalidTuning, f.name, f.d)
+		}
+	}
+	if t.RetainSnapshots < 1 {
+		return fmt.Errorf("%w: %d retained snapshots, at least 1 is needed", ErrInvalidTuning, t.RetainSnapshots)
+	}
+	if t.ApplyTimeout == 0 {
+		return fmt.Errorf("%w: zero apply timeout", ErrInvalidTuning)
+	}
+
+	c := raft.DefaultConfig()
+	c.LocalID = "validate"
+	t.apply(c)
+	if err := raft.ValidateConfig(c); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTuning, err)
+	}
+	if t.ApplyTimeout < t.CommitTimeout {
+		return fmt.Errorf("%w: apply timeout (%s) is below the commit timeout (%s)", ErrInvalidTuning, t.ApplyTimeout, t.CommitTimeout)
+	}
+	return nil
+}
+
+// ApplyTimeout returns how long a write waits to be added to the log, as of
+// Open.
+func (s *Store) ApplyTimeout() time.Duration {
+	return s.tuning.ApplyTimeout
+}
+
+// apply sets the Raft parameters of t in c.
+func (t RaftTuning) apply(c *raft.Config) {
+	c.HeartbeatTimeout = t.HeartbeatTimeout
+	c.ElectionTimeout = t.ElectionTimeout
+	c.LeaderLeaseTimeout = t.LeaderLeaseTimeout
+	c.CommitTimeout = t.CommitTimeout
+	c.SnapshotInterval = t.SnapshotInterval
+	c.SnapshotThreshold = t.SnapshotThreshold
+	c.TrailingLogs = t.TrailingLogs
+}
+
+// raftTuningJSON is the JSON encoding of a RaftTuning.
+type raftTuningJSON struct {
+	HeartbeatTimeout   string `json:"heartbeat_timeout"`
+	ElectionTimeout    string `json:"election_timeout"`
+	LeaderLeaseTimeout string `json:"leader_lease_timeout"`
+	CommitTimeout      string `json:"commit_timeout"`
+	SnapshotInterval   string `json:"snapshot_interval"`
+	SnapshotThreshold  uint64 `json:"snapshot_threshold"`
+	TrailingLogs       uint64 `json:"trailing_logs"`
+	RetainSnapshots    int    `json:"retain_snapshots"`
+	ApplyTimeout       string `json:"apply_timeout"`
+}
+
+// MarshalJSON encodes the durations of t as strings such as "1.5s".
+func (t RaftTuning) MarshalJSON() ([]byte, error) {
+	return json.Marshal(raftTuningJSON{
+		HeartbeatTimeout:   t.HeartbeatTimeout.String(),
+		ElectionTimeout:    t.ElectionTimeout.String(),
+		LeaderLeaseTimeout: t.LeaderLeaseTimeout.String(),
+		CommitTimeout:      t.CommitTimeout.String(),
+		SnapshotInterval:   t.SnapshotInterval.String(),
+		SnapshotThreshold:  t.SnapshotThreshold,
+		TrailingLogs:       t.TrailingLogs,
+		RetainSnapshots:    t.RetainSnapshots,
+		ApplyTimeout:       t.ApplyTimeout.String(),
+	})
+}
+
+// UnmarshalJSON decodes a tuning encoded by MarshalJSON.
+func (t *RaftTuning) UnmarshalJSON(b []byte) error {
+	var v raftTuningJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	tuning := RaftTuning{
+		SnapshotThreshold: v.SnapshotThreshold,
+		TrailingLogs:      v.TrailingLogs,
+		RetainSnapshots:   v.RetainSnapshots,
+	}
+	for _, f := range []struct {
+		s string
+		d *time.Duration
+	}{
+		{v.HeartbeatTimeout, &tuning.HeartbeatTimeout},
+		{v.ElectionTimeout, &tuning.ElectionTimeout},
+		{v.LeaderLeaseTimeout, &tuning.LeaderLeaseTimeout},
+		{v.CommitTimeout, &tuning.CommitTimeout},
+		{v.SnapshotInterval, &tuning.SnapshotInterval},
+		{v.ApplyTimeout, &tuning.ApplyTimeout},
+	} {
+		if f.s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(f.s)
+		if err != nil {
+			return err
+		}
+		*f.d = d
+	}
+	*t = tuning
+	return nil
+}
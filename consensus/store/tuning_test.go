@@ -0,0 +1,42 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRaftTuningValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		change func(*RaftTuning)
+		valid  bool
+	}{
+		{"default", func(*RaftTuning) {}, true},
+		{"no trailing logs", func(t *RaftTuning) { t.TrailingLogs = 0 }, true},
+		{"negative heartbeat", func(t *RaftTuning) { t.HeartbeatTimeout = -time.Second }, false},
+		{"zero election", func(t *RaftTuning) { t.ElectionTimeout = 0 }, false},
+		{"lease above heartbeat", func(t *RaftTuning) { t.LeaderLeaseTimeout = 2 * t.HeartbeatTimeout }, false},
+		{"election below heartbeat", func(t *RaftTuning) { t.ElectionTimeout = t.HeartbeatTimeout / 2 }, false},
+		{"no retained snapshots", func(t *RaftTuning) { t.RetainSnapshots = 0 }, false},
+		{"zero apply timeout", func(t *RaftTuning) { t.ApplyTimeout = 0 }, false},
+		{"apply below commit", func(t *RaftTuning) { t.ApplyTimeout = t.CommitTimeout / 2 }, false},
+	} {
+		tuning := DefaultRaftTuning()
+		tc.change(&tuning)
+		err := tuning.Validate()
+		if tc.valid && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if !tc.valid && !errors.Is(err, ErrInvalidTuning) {
+			t.Errorf("%s: got %v, want ErrInvalidTuning", tc.name, err)
+		}
+	}
+}
+
+func TestStoreKeepsZeroTuning(t *testing.T) {
+	s := openTestStore(t, func(s *Store) { s.Tuning.TrailingLogs = 0 })
+	if got := s.raft.ReloadableConfig().TrailingLogs; got != 0 {
+		t.Fatalf("raft keeps %d trailing logs, want 0", got)
+	}
+}
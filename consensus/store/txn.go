@@ -0,0 +1,216 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Compare targets.
+const (
+	CompareValue          = "value"
+	CompareCreateRevision = "create_revision"
+	CompareModRevision    = "mod_revision"
+	CompareVersion        = "version"
+	CompareExists         = "exists"
+)
+
+// Transaction operation types.
+const (
+	TxnPut    = "put"
+	TxnDelete = "delete"
+)
+
+// ErrInvalidTxn is wrapped by the errors returned for malformed transactions.
+var ErrInvalidTxn = errors.New("invalid transaction")
+
+// Compare is a condition on a key evaluated by a transaction.
+type Compare struct {
+	Key    string `json:"key"`
+	Target string `json:"target"`
+
+	// Result is the comparison operator, one of "=", "!=", "<" and ">". It
+	// defaults to "=". Only "=" and "!=" apply to CompareExists.
+	Result string `json:"result,omitempty"`
+
+	// Value is compared against CompareValue targets.
+	Value []byte `json:"value,omitempty"`
+
+	// Revision is compared against revision and version targets. A missing
+	// key has revision and version 0.
+	Revision uint64 `json:"revision,omitempty"`
+
+	// Exists is compared against CompareExists targets.
+	Exists bool `json:"exists,omitempty"`
+}
+
+// TxnOp is a write performed by a transaction.
+type TxnOp struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+	Lease int64  `json:"lease,omitempty"`
+}
+
+// Txn is a transaction applied atomically in a single log entry. If every
+// comparison holds the Success operations are applied, otherwise the Failure
+// operations are.
+type Txn struct {
+	Compare []Compare `json:"compare,omitempty"`
+	Success []TxnOp   `json:"success,omitempty"`
+	Failure []TxnOp   `json:"failure,omitempty"`
+}
+
+// TxnResult is the outcome of a transaction.
+type TxnResult struct {
+	Succeeded bool   `json:"succeeded"`
+	Revision  uint64 `json:"revision"`
+}
+
+// validate checks the transaction before it is proposed, so that the FSM
+// only sees well-formed transactions.
+func (t *Txn) validate() error {
+	for _, c := range t.Compare {
+		if c.Key == "" {
+			return fmt.Errorf("%w: compare without key", ErrInvalidTxn)
+		}
+		switch c.Target {
+		case CompareValue, CompareCreateRevision, CompareModRevision, CompareVersion:
+			switch c.Result {
+			case "", "=", "!=", "<", ">":
+			default:
+				return fmt.Errorf("%w: unknown compare result %q", ErrInvalidTxn, c.Result)
+			}
+		case CompareExists:
+			switch c.Result {
+			case "", "=", "!=":
+			default:
+				return fmt.Errorf("%w: compare result %q not valid for %s", ErrInvalidTxn, c.Result, c.Target)
+			}
+		default:
+			return fmt.Errorf("%w: unknown compare target %q", ErrInvalidTxn, c.Target)
+		}
+	}
+	for _, ops := range [][]TxnOp{t.Success, t.Failure} {
+		for _, op := range ops {
+			if op.Key == "" {
+				return fmt.Errorf("%w: %s without key", ErrInvalidTxn, op.Type)
+			}
+			if op.Type != TxnPut && op.Type != TxnDelete {
+				return fmt.Errorf("%w: unknown operation %q", ErrInvalidTxn, op.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// Txn applies the transaction atomically through Raft.
+func (s *Store) Txn(t *Txn) (*TxnResult, error) {
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	resp, err := s.apply(&command{
+		Op:  "txn",
+		Txn: t,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*TxnResult), nil
+}
+
+// applyTxn evaluates the comparisons of t and applies one of its branches at
+// the given revision. The caller must hold f.mu.
+func (f *fsm) applyTxn(t *Txn, revision uint64) interface{} {
+	succeeded := true
+	for _, c := range t.Compare {
+		kv, err := f.tx.Get(c.Key)
+		if err != nil {
+			return err
+		}
+		if !compare(c, kv) {
+			succeeded = false
+			break
+		}
+	}
+
+	ops := t.Failure
+	if succeeded {
+		ops = t.Success
+	}
+
+	// Check every lease first so that the branch is applied entirely or not
+	// at all.
+	for _, op := range ops {
+		if _, ok := f.leases[op.Lease]; op.Type == TxnPut && op.Lease != 0 && !ok {
+			return ErrLeaseNotFound
+		}
+	}
+	for _, op := range ops {
+		var err error
+		switch op.Type {
+		case TxnPut:
+			err = f.applySet(op.Key, op.Value, op.Lease, revision)
+		case TxnDelete:
+			err = f.applyDelete(op.Key, revision)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return &TxnResult{Succeeded: succeeded, Revision: revision}
+}
+
+// compare evaluates c against kv, which is nil if the key does not exist.
+func compare(c Compare, kv *KeyValue) bool {
+	if c.Target == CompareExists {
+		if c.Result == "!=" {
+			return (kv != nil) != c.Exists
+		}
+		return (kv != nil) == c.Exists
+	}
+
+	if c.Target == CompareValue {
+		if kv == nil {
+			// A missing key has no value to compare.
+			return c.Result == "!="
+		}
+		return compareResult(c.Result, bytes.Compare(kv.Value, c.Value))
+	}
+
+	var actual uint64
+	if kv != nil {
+		switch c.Target {
+		case CompareCreateRevision:
+			actual = kv.CreateRevision
+		case CompareModRevision:
+			actual = kv.ModRevision
+		case CompareVersion:
+			actual = kv.Version
+		}
+	}
+	switch {
+	case actual < c.Revision:
+		return compareResult(c.Result, -1)
+	case actual > c.Revision:
+		return compareResult(c.Result, 1)
+	default:
+		return compareResult(c.Result, 0)
+	}
+}
+
+// compareResult reports whether the ordering cmp of the actual value against
+// the expected one satisfies result.
+func compareResult(result string, cmp int) bool {
+	switch result {
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp == 0
+	}
+}
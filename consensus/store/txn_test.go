@@ -0,0 +1,148 @@
+package store
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTxnValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		txn   Txn
+		valid bool
+	}{
+		{"empty", Txn{}, true},
+		{"every target", Txn{Compare: []Compare{
+			{Key: "a", Target: CompareValue, Result: "<"},
+			{Key: "a", Target: CompareCreateRevision, Result: ">"},
+			{Key: "a", Target: CompareModRevision, Result: "!="},
+			{Key: "a", Target: CompareVersion},
+			{Key: "a", Target: CompareExists, Result: "="},
+		}, Success: []TxnOp{{Type: TxnPut, Key: "a"}}, Failure: []TxnOp{{Type: TxnDelete, Key: "a"}}}, true},
+		{"compare without key", Txn{Compare: []Compare{{Target: CompareValue}}}, false},
+		{"unknown target", Txn{Compare: []Compare{{Key: "a", Target: "lease"}}}, false},
+		{"unknown result", Txn{Compare: []Compare{{Key: "a", Target: CompareValue, Result: ">="}}}, false},
+		{"ordered exists", Txn{Compare: []Compare{{Key: "a", Target: CompareExists, Result: "<"}}}, false},
+		{"op without key", Txn{Success: []TxnOp{{Type: TxnPut}}}, false},
+		{"unknown op", Txn{Failure: []TxnOp{{Type: "get", Key: "a"}}}, false},
+	} {
+		err := tc.txn.validate()
+		if tc.valid && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if !tc.valid && !errors.Is(err, ErrInvalidTxn) {
+			t.Errorf("%s: got %v, want ErrInvalidTxn", tc.name, err)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	kv := &KeyValue{Key: "a", Value: []byte("m"), CreateRevision: 2, ModRevision: 5, Version: 3}
+	for _, tc := range []struct {
+		c    Compare
+		kv   *KeyValue
+		want bool
+	}{
+		{Compare{Target: CompareValue, Value: []byte("m")}, kv, true},
+		{Compare{Target: CompareValue, Result: "!=", Value: []byte("m")}, kv, false},
+		{Compare{Target: CompareValue, Result: "<", Value: []byte("z")}, kv, true},
+		{Compare{Target: CompareValue, Result: ">", Value: []byte("z")}, kv, false},
+		{Compare{Target: CompareValue, Value: []byte("m")}, nil, false},
+		{Compare{Target: CompareValue, Result: "!=", Value: []byte("m")}, nil, true},
+		{Compare{Target: CompareCreateRevision, Revision: 2}, kv, true},
+		{Compare{Target: CompareModRevision, Result: ">", Revision: 4}, kv, true},
+		{Compare{Target: CompareModRevision, Result: "<", Revision: 5}, kv, false},
+		{Compare{Target: CompareVersion, Result: "!=", Revision: 3}, kv, false},
+		{Compare{Target: CompareVersion, Revision: 0}, nil, true},
+		{Compare{Target: CompareModRevision, Result: "<", Revision: 1}, nil, true},
+		{Compare{Target: CompareExists, Exists: true}, kv, true},
+		{Compare{Target: CompareExists, Exists: true}, nil, false},
+		{Compare{Target: CompareExists, Result: "!=", Exists: true}, nil, true},
+	} {
+		if got := compare(tc.c, tc.kv); got != tc.want {
+			t.Errorf("%+v against %+v: got %v, want %v", tc.c, tc.kv, got, tc.want)
+		}
+	}
+}
+
+func TestTxnBranches(t *testing.T) {
+	s := openTestStore(t)
+	for _, key := range []string{"a", "old"} {
+		if err := s.Set(key, []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	branches := func(cmp Compare) *Txn {
+		return &Txn{
+			Compare: []Compare{{Key: "a", Target: CompareExists, Exists: true}, cmp},
+			Success: []TxnOp{{Type: TxnPut, Key: "success", Value: []byte("1")}, {Type: TxnDelete, Key: "old"}},
+			Failure: []TxnOp{{Type: TxnPut, Key: "failure", Value: []byte("1")}},
+		}
+	}
+
+	// One comparison that fails selects the failure branch.
+	res, err := s.Txn(branches(Compare{Key: "a", Target: CompareValue, Value: []byte("2")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Succeeded || res.Revision != s.Revision() {
+		t.Fatalf("got %+v, want a failed txn at revision %d", res, s.Revision())
+	}
+	if !exists(t, s, "failure") || exists(t, s, "success") || !exists(t, s, "old") {
+		t.Fatal("failed txn did not apply only its failure branch")
+	}
+
+	res, err = s.Txn(branches(Compare{Key: "a", Target: CompareValue, Value: []byte("1")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Succeeded {
+		t.Fatalf("got %+v, want a succeeded txn", res)
+	}
+	if !exists(t, s, "success") || exists(t, s, "old") {
+		t.Fatal("succeeded txn did not apply its success branch")
+	}
+	if kv, _ := s.Get("success", ReadOptions{}); kv.ModRevision != res.Revision {
+		t.Fatalf("success written at revision %d, want %d", kv.ModRevision, res.Revision)
+	}
+}
+
+func TestTxnAtomic(t *testing.T) {
+	s := openTestStore(t)
+	if err := s.SetNamespace("team", NamespaceLimits{MaxKeys: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		txn  *Txn
+		want error
+	}{
+		"missing lease": {&Txn{Success: []TxnOp{
+			{Type: TxnPut, Key: "x", Value: []byte("1")},
+			{Type: TxnPut, Key: "y", Value: []byte("1"), Lease: 999},
+		}}, ErrLeaseNotFound},
+		"quota": {&Txn{Success: []TxnOp{
+			{Type: TxnPut, Key: "team/x", Value: []byte("1")},
+			{Type: TxnPut, Key: "team/y", Value: []byte("1")},
+		}}, ErrQuotaExceeded},
+	} {
+		if _, err := s.Txn(tc.txn); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", name, err, tc.want)
+		}
+		for _, op := range tc.txn.Success {
+			if exists(t, s, op.Key) {
+				t.Errorf("%s: %s written by a failed txn", name, op.Key)
+			}
+		}
+	}
+}
+
+// exists reports whether s holds key.
+func exists(t *testing.T, s *Store, key string) bool {
+	t.Helper()
+	kv, err := s.Get(key, ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv != nil
+}
@@ -0,0 +1,195 @@
+package store
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+const (
+	// watchHistorySize is the number of recent events kept so that watchers
+	// can resume from a past revision.
+	watchHistorySize = 10000
+
+	// watcherBufferSize is the number of events buffered for a watcher. A
+	// watcher that falls further behind is closed with ErrWatcherOverflow.
+	watcherBufferSize = 256
+)
+
+// Event types.
+const (
+	EventPut    = "put"
+	EventDelete = "delete"
+)
+
+var (
+	// ErrCompacted is returned when a watch asks to resume from a revision
+	// that is no longer in the event history.
+	ErrCompacted = errors.New("revision compacted")
+
+	// ErrWatcherOverflow ends a watch whose consumer did not keep up with the
+	// rate of changes. It can resume from the revision of the last event it
+	// received: a log entry may change several keys at the same revision,
+	// and the watch may have ended between them, so the events of that
+	// revision are delivered again.
+	ErrWatcherOverflow = errors.New("watcher fell behind")
+
+	// ErrWatcherClosed ends a watch that was closed by its owner or because
+	// the store shut down.
+	ErrWatcherClosed = errors.New("watcher closed")
+)
+
+// Event is a change to a key. The changes of a log entry, such as the
+// writes of a batch or the ops of a transaction, share its revision.
+type Event struct {
+	Type     string `json:"type"`
+	Key      string `json:"key"`
+	Revision uint64 `json:"revision"`
+
+	// KV is the entry written by a put. It is nil for deletes.
+	KV *KeyValue `json:"kv,omitempty"`
+}
+
+// Watcher delivers, in order, the events for a key or a key prefix.
+type Watcher struct {
+	key    string
+	prefix bool
+
+	ch  chan Event
+	err error
+
+	hub *watchHub
+	mu  *sync.Mutex // Guards hub, the store mutex.
+}
+
+// Events returns the channel the events are delivered on. It is closed when
+// the watch ends, after which Err reports why.
+func (w *Watcher) Events() <-chan Event {
+	return w.ch
+}
+
+// Err returns the reason the watch ended, once Events is closed.
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close ends the watch.
+func (w *Watcher) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.hub.remove(w, ErrWatcherClosed)
+}
+
+func (w *Watcher) matches(key string) bool {
+	if w.prefix {
+		return strings.HasPrefix(key, w.key)
+	}
+	return key == w.key
+}
+
+// watchHub fans FSM events out to watchers and keeps a bounded history of
+// them. It is guarded by the store mutex, which the FSM holds while applying
+// entries, so events are recorded in log order.
+type watchHub struct {
+	history  []Event
+	start    int    // Position of the oldest event in history.
+	count    int    // Number of events in history.
+	horizon  uint64 // Events at or below this revision may be missing.
+	watchers map[*Watcher]struct{}
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{
+		history:  make([]Event, watchHistorySize),
+		watchers: make(map[*Watcher]struct{}),
+	}
+}
+
+// notify records ev and delivers it to the matching watchers.
+func (h *watchHub) notify(ev Event) {
+	if h.count == len(h.history) {
+		h.horizon = h.history[h.start].Revision
+		h.start = (h.start + 1) % len(h.history)
+		h.count--
+	}
+	h.history[(h.start+h.count)%len(h.history)] = ev
+	h.count++
+
+	for w := range h.watchers {
+		if !w.matches(ev.Key) {
+			continue
+		}
+		select {
+		case w.ch <- ev:
+		default:
+			h.remove(w, ErrWatcherOverflow)
+		}
+	}
+}
+
+// add registers w, first queueing the recorded events at or after rev. rev
+// is compacted if an event of that revision was dropped from the history,
+// even if others remain.
+func (h *watchHub) add(w *Watcher, rev uint64) error {
+	var replay []Event
+	if rev > 0 {
+		if rev <= h.horizon {
+			return ErrCompacted
+		}
+		for i := 0; i < h.count; i++ {
+			ev := h.history[(h.start+i)%len(h.history)]
+			if ev.Revision >= rev && w.matches(ev.Key) {
+				replay = append(replay, ev)
+			}
+		}
+	}
+
+	w.ch = make(chan Event, watcherBufferSize+len(replay))
+	for _, ev := range replay {
+		w.ch <- ev
+	}
+	h.watchers[w] = struct{}{}
+	return nil
+}
+
+// remove unregisters w and ends its watch with err.
+func (h *watchHub) remove(w *Watcher, err error) {
+	if _, ok := h.watchers[w]; !ok {
+		return
+	}
+	delete(h.watchers, w)
+	w.err = err
+	close(w.ch)
+}
+
+// reset drops the history and ends every watch. It is used when the state
+// is replaced by a snapshot at revision, as watchers may have missed changes.
+func (h *watchHub) reset(revision uint64) {
+	for w := range h.watchers {
+		h.remove(w, ErrCompacted)
+	}
+	h.start, h.count = 0, 0
+	h.horizon = revision
+}
+
+// Watch returns a watcher for key, or for every key starting with key if
+// prefix is set. If rev is not zero the watcher first receives the recorded
+// events from that revision on, or ErrCompacted is returned if some of them
+// are no longer available.
+func (s *Store) Watch(key string, prefix bool, rev uint64) (*Watcher, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w := &Watcher{
+		key:    key,
+		prefix: prefix,
+		hub:    s.watches,
+		mu:     &s.mu,
+	}
+	if err := s.watches.add(w, rev); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
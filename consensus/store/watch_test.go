@@ -0,0 +1,52 @@
+package store
+
+import (
+	"sync"
+	"testing"
+)
+
+// watchFrom registers a watcher of every key on h from rev.
+func watchFrom(h *watchHub, rev uint64) (*Watcher, error) {
+	w := &Watcher{prefix: true, hub: h, mu: &sync.Mutex{}}
+	return w, h.add(w, rev)
+}
+
+func TestWatchResumesSharedRevision(t *testing.T) {
+	h := newWatchHub()
+	h.notify(Event{Type: EventPut, Key: "a", Revision: 5})
+	// A batch applied at revision 6.
+	for _, key := range []string{"b", "c", "d"} {
+		h.notify(Event{Type: EventPut, Key: key, Revision: 6})
+	}
+
+	// A watcher that ended after receiving b resumes from its revision and
+	// gets every event of it again.
+	w, err := watchFrom(h, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for len(w.ch) > 0 {
+		keys = append(keys, (<-w.ch).Key)
+	}
+	if len(keys) != 3 || keys[0] != "b" || keys[2] != "d" {
+		t.Fatalf("replayed %q, want b, c and d", keys)
+	}
+}
+
+func TestWatchCompactsPartialRevision(t *testing.T) {
+	h := newWatchHub()
+	h.notify(Event{Type: EventPut, Key: "a", Revision: 1})
+	h.notify(Event{Type: EventPut, Key: "b", Revision: 1})
+	for i := 0; i < watchHistorySize-1; i++ {
+		h.notify(Event{Type: EventPut, Key: "c", Revision: 2})
+	}
+
+	// Only the event of b is left of revision 1.
+	if _, err := watchFrom(h, 1); err != ErrCompacted {
+		t.Fatalf("resumed from a partly dropped revision: %v", err)
+	}
+	if _, err := watchFrom(h, 2); err != nil {
+		t.Fatal(err)
+	}
+}
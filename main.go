@@ -7,6 +7,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/spf13/viper"
 	"github.com/spf13/pflag"
@@ -14,6 +15,7 @@ import (
 	"github.com/raestrada/sappers/cluster"
 	"github.com/raestrada/sappers/members"
 	"github.com/raestrada/sappers/consensus"
+	"github.com/raestrada/sappers/consensus/store"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -24,14 +26,61 @@ const (
 	DefaultRaftAddr = ":12000"
 )
 
+// shutdownTimeout limita cuánto espera el apagado a que el nodo salga del clúster
+const shutdownTimeout = 30 * time.Second
+
+// Subcomandos de administración, que no arrancan el agente
+var commands = map[string]func(args []string) error{
+	"backup":  runBackup,
+	"restore": runRestore,
+}
+
 func main() {
-	// Definir los parámetros de CLI con pflag
+	// Ejecutar un subcomando si se pidió uno, en lugar del agente
+	if len(os.Args) > 1 {
+		if run, ok := commands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil && err != pflag.ErrHelp {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	// Definir los parámetros de CLI con pflag; los de Raft toman por defecto
+	// los del almacén
+	tuning := store.DefaultRaftTuning()
 	pflag.Int("gossip-port", 7946, "Puerto para gossip")
 	pflag.String("raft-addr", ":12000", "Dirección para Raft")
 	pflag.String("http-addr", ":11000", "Dirección HTTP")
 	pflag.String("node-id", "default-node", "ID del nodo")
 	pflag.String("log-level", "ERROR", "Nivel de logs")
 	pflag.StringSlice("peers", []string{"127.0.0.1"}, "Peers del clúster")
+	pflag.Bool("forward-writes", true, "Reenviar las escrituras de los seguidores al líder")
+	pflag.Bool("snapshot-compression", false, "Comprimir los snapshots de Raft con gzip")
+	pflag.String("fsm-backend", "memory", "Almacenamiento del estado replicado (memory o bolt)")
+	pflag.Int("batch-max-size", 128, "Máximo de escrituras agrupadas en una entrada del log (0 o 1 desactiva el agrupamiento)")
+	pflag.Duration("batch-delay", 0, "Tiempo que un grupo de escrituras espera a más escrituras antes de proponerse")
+	pflag.Duration("raft-heartbeat-timeout", tuning.HeartbeatTimeout, "Tiempo sin contacto con el líder antes de iniciar una elección")
+	pflag.Duration("raft-election-timeout", tuning.ElectionTimeout, "Tiempo que un candidato espera los votos antes de repetir la elección")
+	pflag.Duration("raft-leader-lease-timeout", tuning.LeaderLeaseTimeout, "Tiempo que el líder sigue siéndolo sin contacto con un quórum")
+	pflag.Duration("raft-commit-timeout", tuning.CommitTimeout, "Espera máxima del líder antes de enviar entradas o un heartbeat")
+	pflag.Duration("raft-snapshot-interval", tuning.SnapshotInterval, "Cada cuánto Raft comprueba si debe tomar un snapshot")
+	pflag.Uint64("raft-snapshot-threshold", tuning.SnapshotThreshold, "Entradas del log desde el último snapshot que provocan uno nuevo")
+	pflag.Uint64("raft-trailing-logs", tuning.TrailingLogs, "Entradas del log que se conservan tras un snapshot")
+	pflag.Int("raft-retain-snapshots", tuning.RetainSnapshots, "Snapshots que se conservan en el directorio de Raft")
+	pflag.Duration("raft-apply-timeout", tuning.ApplyTimeout, "Tiempo máximo de espera para añadir una escritura al log")
+	pflag.Int("voter-target", 0, "Número de votantes que busca el líder; con 0 todos los nodos se unen como votantes")
+	pflag.Duration("server-stabilization", 10*time.Second, "Tiempo que un servidor debe estar sano antes de promoverlo, o caído antes de degradarlo")
+	pflag.Uint64("promotion-max-lag", 1024, "Revisiones que un no votante puede ir por detrás del líder y aun así ser promovido")
+	pflag.Bool("leave-on-terminate", false, "Salir de la configuración de Raft al recibir SIGINT o SIGTERM; solo para nodos que no vuelven")
+	pflag.Duration("dead-server-grace", 5*time.Minute, "Tiempo que un servidor puede faltar en gossip antes de quitarlo de la configuración de Raft")
+	pflag.Int("min-quorum", 0, "Mínimo de votantes que deja el líder al quitar servidores caídos")
+	pflag.StringSlice("recover-peers", nil, "Modo de recuperación: servidores supervivientes como id=dirección, quitar una vez recuperado el clúster")
+	pflag.String("raft-tls-cert", "", "Certificado PEM del nodo para el transporte de Raft; activa TLS mutuo")
+	pflag.String("raft-tls-key", "", "Clave privada PEM del certificado de Raft")
+	pflag.String("raft-tls-ca", "", "Certificados PEM de la CA que firma los certificados de los nodos")
+	pflag.Bool("raft-tls-verify-id", true, "Exigir que el certificado de cada nodo nombre su ID de servidor")
 
 	// Parsear los parámetros de CLI
 	pflag.Parse()
@@ -47,6 +96,11 @@ func main() {
 
 	zap.L().Info("STDOUT Global Logger started", zap.String("nodeID", cfg.NodeID))
 
+	// Validar la configuración de Raft antes de arrancar nada
+	if err := consensus.ValidateConfig(cfg); err != nil {
+		zap.L().Fatal("main", zap.String("type", "invalid raft configuration"), zap.Error(err))
+	}
+
 	// Crear un contexto para manejar la interrupción
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -56,7 +110,11 @@ func main() {
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
 	// Iniciar el clúster en una goroutine
-	go startCluster(ctx)
+	done := make(chan struct{})
+	go func() {
+		startCluster(ctx)
+		close(done)
+	}()
 
 	// Esperar la señal de interrupción
 	select {
@@ -66,6 +124,14 @@ func main() {
 	}
 
 	fmt.Println("Shutting down gracefully...")
+
+	// Esperar a que el nodo ceda el liderazgo y salga del clúster, sin
+	// bloquear el apagado indefinidamente
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		fmt.Println("Timed out leaving the cluster")
+	}
 }
 
 // startCluster inicia el clúster